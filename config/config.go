@@ -2,19 +2,66 @@ package config
 
 import (
 	"log"
+	"net/netip"
 	"os"
+	"strings"
 )
 
 var DOMAIN string
 
+// Domain the session cookie is scoped to, shared by all subdomains
+var COOKIE_DOMAIN string
+
+// Host serving the login page for all protected subdomains
+var LOGIN_HOST string
+
+// Proxies in front of Latios whose X-Forwarded-For header is trusted
+var TRUSTED_PROXIES []netip.Prefix
+
 func LoadConfig() {
 	DOMAIN = os.Getenv("DOMAIN")
 	if DOMAIN == "" {
 		log.Fatal("DOMAIN not set")
 		os.Exit(1)
 	}
+
+	COOKIE_DOMAIN = strings.ToLower(GetEnv("COOKIE_DOMAIN", DOMAIN))
+	LOGIN_HOST = strings.ToLower(GetEnv("LOGIN_HOST", DOMAIN))
+
+	TRUSTED_PROXIES = nil
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES entry %q: %v", entry, err)
+		}
+		TRUSTED_PROXIES = append(TRUSTED_PROXIES, prefix)
+	}
+}
+
+// parsePrefix reads an address range like 10.0.0.0/8 or a single address
+func parsePrefix(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
 }
 
 func GetDomain() string {
 	return DOMAIN
 }
+
+// GetEnv reads an environment variable, fallback is used when it is unset or empty
+func GetEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
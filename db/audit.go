@@ -0,0 +1,82 @@
+package db
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// Audited actions
+const (
+	AuditLogin            = "login"
+	AuditRouteCreate      = "route.create"
+	AuditRouteUpdate      = "route.update"
+	AuditRouteDelete      = "route.delete"
+	AuditRouteImport      = "route.import"
+	AuditRouteRestore     = "route.restore"
+	AuditRouteSync        = "route.sync"
+	AuditUserCreate       = "user.create"
+	AuditUserDelete       = "user.delete"
+	AuditUserRole         = "user.role"
+	AuditUserGroups       = "user.groups"
+	AuditTOTPEnable       = "user.totp.enable"
+	AuditTOTPDisable      = "user.totp.disable"
+	AuditLogout           = "logout"
+	AuditSessionEnd       = "session.revoke"
+	AuditWebAuthnRegister = "user.passkey.add"
+	AuditWebAuthnDelete   = "user.passkey.remove"
+	AuditUserPassword     = "user.password"
+	AuditTokenCreate      = "user.token.create"
+	AuditTokenRevoke      = "user.token.revoke"
+	AuditOIDCClientCreate = "oidc.client.create"
+	AuditOIDCClientDelete = "oidc.client.delete"
+	AuditOIDCAuthorize    = "oidc.authorize"
+)
+
+// RecordAudit stores an audit entry, failures are only logged so they never block the action itself
+func RecordAudit(entry AuditLog) {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	// UTC keeps the text timestamps of sqlite comparable
+	entry.Timestamp = entry.Timestamp.UTC()
+	if err := Client.Create(&entry).Error; err != nil {
+		log.Printf("[AUDIT] Failed to record %s by %s: %v", entry.Action, entry.Actor, err)
+	}
+}
+
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Result string
+	Since  time.Time
+	Until  time.Time
+}
+
+// AuditLogs lists matching entries newest first
+func AuditLogs(filter AuditFilter, limit, offset int) ([]AuditLog, error) {
+	query := Client.Order("timestamp desc").Limit(limit).Offset(offset)
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.Result != "" {
+		query = query.Where("result = ?", filter.Result)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("timestamp >= ?", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("timestamp <= ?", filter.Until.UTC())
+	}
+
+	var logs []AuditLog
+	err := query.Find(&logs).Error
+	return logs, err
+}
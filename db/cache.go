@@ -0,0 +1,145 @@
+package db
+
+import (
+	"log"
+	"sync"
+)
+
+// MemoryRoutes holds every route grouped by domain, sorted by descending prefix length.
+// The slices are never modified in place, readers may keep them after releasing the lock.
+var MemoryRoutes = make(map[string][]Route)
+var routeCacheLock sync.RWMutex
+
+var routeListeners []func()
+var routeListenersLock sync.Mutex
+
+// OnRoutesChanged registers a callback that runs after the cached routes changed
+func OnRoutesChanged(listener func()) {
+	routeListenersLock.Lock()
+	defer routeListenersLock.Unlock()
+	routeListeners = append(routeListeners, listener)
+}
+
+func notifyRoutesChanged() {
+	routeListenersLock.Lock()
+	listeners := append([]func(){}, routeListeners...)
+	routeListenersLock.Unlock()
+
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+func loadRoutesIntoMemory() error {
+	var RouteList []Route
+	result := Client.Find(&RouteList)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	routes := make(map[string][]Route)
+	for _, route := range RouteList {
+		routes[route.Domain] = append(routes[route.Domain], route)
+	}
+	for _, domainRoutes := range routes {
+		sortRoutes(domainRoutes)
+	}
+
+	routeCacheLock.Lock()
+	MemoryRoutes = routes
+	routeCacheLock.Unlock()
+
+	notifyRoutesChanged()
+	return nil
+}
+
+// HasDomain reports whether any cached route serves the domain
+func HasDomain(domain string) bool {
+	routeCacheLock.RLock()
+	defer routeCacheLock.RUnlock()
+	return len(MemoryRoutes[domain]) > 0
+}
+
+// GetRoute resolves the route for a host and request path from memory only. The cache holds
+// every route, it is loaded at startup and kept in sync, so a miss needs no database query.
+func GetRoute(domain, path string) (Route, error) {
+	routeCacheLock.RLock()
+	routes := MemoryRoutes[domain]
+	routeCacheLock.RUnlock()
+
+	route, ok := MatchRoute(routes, path)
+	if !ok {
+		return route, ErrRouteNotFound
+	}
+	return route, nil
+}
+
+// CachedRoutes returns a snapshot of all routes held in memory
+func CachedRoutes() []Route {
+	routeCacheLock.RLock()
+	defer routeCacheLock.RUnlock()
+
+	var routes []Route
+	for _, domainRoutes := range MemoryRoutes {
+		routes = append(routes, domainRoutes...)
+	}
+	return routes
+}
+
+// AddRouteToCache stores a route saved to the database
+func AddRouteToCache(route Route) {
+	routeCacheLock.Lock()
+
+	// The route might have moved to another domain
+	if route.ID != 0 {
+		removeCachedRoute(func(cached Route) bool { return cached.ID == route.ID })
+	}
+
+	routes := make([]Route, 0, len(MemoryRoutes[route.Domain])+1)
+	for _, cached := range MemoryRoutes[route.Domain] {
+		if cached.PathPrefix != route.PathPrefix {
+			routes = append(routes, cached)
+		}
+	}
+	routes = append(routes, route)
+	sortRoutes(routes)
+
+	MemoryRoutes[route.Domain] = routes
+	routeCacheLock.Unlock()
+
+	log.Printf("[CACHE] Added route: %s%s", route.Domain, route.PathPrefix)
+	notifyRoutesChanged()
+}
+
+// DeleteRouteFromCache drops a route deleted from the database
+func DeleteRouteFromCache(domain, pathPrefix string) {
+	routeCacheLock.Lock()
+	removeCachedRoute(func(cached Route) bool {
+		return cached.Domain == domain && cached.PathPrefix == pathPrefix
+	})
+	routeCacheLock.Unlock()
+
+	log.Printf("[CACHE] Deleted route: %s%s", domain, pathPrefix)
+	notifyRoutesChanged()
+}
+
+// removeCachedRoute drops every cached route matching the filter, the write lock must be held
+func removeCachedRoute(matches func(Route) bool) {
+	for domain, domainRoutes := range MemoryRoutes {
+		routes := make([]Route, 0, len(domainRoutes))
+		for _, cached := range domainRoutes {
+			if !matches(cached) {
+				routes = append(routes, cached)
+			}
+		}
+
+		if len(routes) == len(domainRoutes) {
+			continue
+		}
+		if len(routes) == 0 {
+			delete(MemoryRoutes, domain)
+		} else {
+			MemoryRoutes[domain] = routes
+		}
+	}
+}
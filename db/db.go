@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"sync"
 
+	"github.com/glebarez/sqlite"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -15,19 +15,28 @@ import (
 )
 
 var Client *gorm.DB
-var MemoryRoutes = make(map[string]Route)
-var routeCacheLock sync.RWMutex
 
 func InitDB() {
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
-		getEnv("DB_HOST", "latios-db"),
-		getEnv("DB_USER", "user"),
-		getEnv("DB_PASSWORD", "pass"),
-		getEnv("DB_NAME", "latios"),
-		getEnv("DB_PORT", "5432"),
-	)
+	Connect()
+
+	err := Migrate()
+	if err != nil {
+		log.Fatalf("failed to migrate: %v", err)
+	}
+
+	err = ensureBaseUser()
+	if err != nil {
+		log.Fatalf("failed to ensure base admin user: %v", err)
+	}
+
+	err = loadRoutesIntoMemory()
+	if err != nil {
+		log.Fatalf("failed to load routes into memory: %v", err)
+	}
+}
 
-	var err error
+// Connect opens the database configured through DB_DRIVER without touching the schema
+func Connect() {
 	gormConfig := &gorm.Config{
 		Logger: gormLogger.New(
 			log.New(os.Stdout, "\r\n", log.LstdFlags),
@@ -36,46 +45,42 @@ func InitDB() {
 			},
 		),
 	}
-	Client, err = gorm.Open(postgres.Open(dsn), gormConfig)
-	if err != nil {
-		log.Fatalf("failed to connect database: %v", err)
-	}
 
-	err = Client.AutoMigrate(
-		&Route{},
-		&RequestLog{},
-		&User{},
-	)
+	dialector, err := openDialector(getEnv("DB_DRIVER", "postgres"))
 	if err != nil {
-		log.Fatalf("failed to migrate: %v", err)
+		log.Fatalf("failed to configure database: %v", err)
 	}
 
-	err = ensureBaseUser()
+	Client, err = gorm.Open(dialector, gormConfig)
 	if err != nil {
-		log.Fatalf("failed to ensure base admin user: %v", err)
+		log.Fatalf("failed to connect database: %v", err)
 	}
+}
 
-	err = loadRoutesIntoMemory()
-	if err != nil {
-		log.Fatalf("failed to load routes into memory: %v", err)
-	}
+func postgresDSN() string {
+	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
+		getEnv("DB_HOST", "latios-db"),
+		getEnv("DB_USER", "user"),
+		getEnv("DB_PASSWORD", "pass"),
+		getEnv("DB_NAME", "latios"),
+		getEnv("DB_PORT", "5432"),
+	)
 }
 
-func loadRoutesIntoMemory() error {
-	var RouteList []Route
-	result := Client.Find(&RouteList)
-	if result.Error != nil {
-		log.Fatalf("failed to load routes into memory: %v", result.Error)
-		return result.Error
-	}
+// openDialector builds the GORM dialector for DB_DRIVER, postgres or sqlite
+func openDialector(driver string) (gorm.Dialector, error) {
+	switch driver {
+	case "postgres":
+		return postgres.Open(postgresDSN()), nil
 
-	routeCacheLock.Lock()
-	defer routeCacheLock.Unlock()
+	case "sqlite":
+		path := getEnv("DB_PATH", "/data/latios.db")
+		log.Printf("[DB] Using sqlite database at %s", path)
+		return sqlite.Open(path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"), nil
 
-	for _, route := range RouteList {
-		MemoryRoutes[route.Domain] = route
+	default:
+		return nil, fmt.Errorf("unsupported DB_DRIVER %q, use postgres or sqlite", driver)
 	}
-	return nil
 }
 
 func getEnv(key, fallback string) string {
@@ -108,6 +113,7 @@ func ensureBaseUser() error {
 		user := User{
 			Username: "admin",
 			Password: string(hashedPassword),
+			Role:     RoleAdmin,
 		}
 
 		if err := Client.Create(&user).Error; err != nil {
@@ -125,45 +131,3 @@ func ensureBaseUser() error {
 	return nil
 
 }
-
-func GetRoute(domain string) (Route, error) {
-
-	// * This can be put beforehand to optimize cache access
-	// routeCacheLock.RLock()
-	// route, ok := MemoryRoutes[domain]
-	// routeCacheLock.RUnlock()
-
-	// if ok {
-	// 	return route, nil
-	// }
-
-	routeCacheLock.Lock()
-	defer routeCacheLock.Unlock()
-
-	route, ok := MemoryRoutes[domain]
-	if ok {
-		return route, nil
-	}
-
-	log.Print("Route not in memory, checking database")
-	if Client.Where("domain = ?", domain).First(&route).Error != nil {
-		return route, fmt.Errorf("route not found")
-	}
-
-	MemoryRoutes[domain] = route
-	return route, nil
-}
-
-func AddRouteToCache(route Route) {
-	routeCacheLock.Lock()
-	defer routeCacheLock.Unlock()
-	MemoryRoutes[route.Domain] = route
-	log.Printf("[CACHE] Added route: %s", route.Domain)
-}
-
-func DeleteRouteFromCache(domain string) {
-	routeCacheLock.Lock()
-	defer routeCacheLock.Unlock()
-	delete(MemoryRoutes, domain)
-	log.Printf("[CACHE] Deleted route: %s", domain)
-}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+
+	"gorm.io/gorm"
+)
+
+// Login methods of users
+const (
+	SourceLocal = "local"
+	SourceOIDC  = "oidc"
+	SourceLDAP  = "ldap"
+)
+
+var ErrSourceMismatch = errors.New("the username belongs to a user with another login method")
+
+// SyncExternalUser creates or updates a user that was authenticated by an external identity
+// provider. Groups that are not valid names are dropped. An empty role keeps the role of
+// existing users and makes new users viewers. Changes log the user out of older sessions.
+func SyncExternalUser(source, username, role string, groups []string) (User, error) {
+	if !usernamePattern.MatchString(username) {
+		return User{}, &ValidationError{Errors: []FieldError{{
+			Field:   "username",
+			Message: "must be 3 to 64 characters of letters, digits, dot, dash or underscore",
+		}}}
+	}
+	if role != "" {
+		if err := validateRole(role); err != nil {
+			return User{}, err
+		}
+	}
+	groups = slices.DeleteFunc(normalizeNames(groups), func(group string) bool {
+		return !usernamePattern.MatchString(group)
+	})
+
+	var user User
+	err := Client.Transaction(func(tx *gorm.DB) error {
+		var err error
+		user, err = userByName(tx, username)
+		if errors.Is(err, ErrUserNotFound) {
+			return createExternalUser(tx, &user, source, username, role, groups)
+		}
+		if err != nil {
+			return err
+		}
+		if user.Source != source {
+			return ErrSourceMismatch
+		}
+
+		changed := !slices.Equal(user.Groups, groups)
+		user.Groups = groups
+		if role != "" && role != user.Role {
+			// The last administrator keeps the role, like in UpdateUser
+			last, err := lastAdmin(tx, user)
+			if err != nil {
+				return err
+			}
+			if !last {
+				user.Role = role
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+
+		if err := tx.Model(&user).Select("role", "groups").Updates(&user).Error; err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, user.ID, "")
+	})
+	return user, err
+}
+
+// createExternalUser stores a new external user with a random password nobody knows
+func createExternalUser(tx *gorm.DB, user *User, source, username, role string, groups []string) error {
+	if role == "" {
+		role = RoleViewer
+	}
+
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	hashed, err := hashPassword(hex.EncodeToString(bytes))
+	if err != nil {
+		return err
+	}
+
+	*user = User{Username: username, Password: hashed, Role: role, Groups: groups, Source: source}
+	return tx.Create(user).Error
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS request_logs;
+DROP TABLE IF EXISTS routes;
@@ -0,0 +1,41 @@
+-- Baseline schema. Written idempotently so databases created by the former
+-- AutoMigrate setup are brought to the same state.
+CREATE TABLE IF NOT EXISTS routes (
+	id bigserial PRIMARY KEY,
+	domain text,
+	target_path text,
+	is_static boolean,
+	enforce_auth boolean
+);
+
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS path_prefix text NOT NULL DEFAULT '';
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS strip_prefix boolean;
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS targets text;
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS load_balancing text NOT NULL DEFAULT 'round_robin';
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS health_check_path text;
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS health_check_interval bigint NOT NULL DEFAULT 10;
+
+DROP INDEX IF EXISTS idx_routes_domain;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_routes_domain_path ON routes (domain, path_prefix);
+
+CREATE TABLE IF NOT EXISTS request_logs (
+	id bigserial PRIMARY KEY,
+	timestamp timestamptz,
+	method text,
+	host text,
+	path text,
+	status_code bigint,
+	latency_ms bigint,
+	remote_addr text
+);
+
+CREATE INDEX IF NOT EXISTS idx_request_logs_timestamp ON request_logs (timestamp);
+CREATE INDEX IF NOT EXISTS idx_request_logs_host ON request_logs (host);
+
+CREATE TABLE IF NOT EXISTS users (
+	id bigserial PRIMARY KEY,
+	username text,
+	password text
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users (username);
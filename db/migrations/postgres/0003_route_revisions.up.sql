@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS route_revisions (
+	id bigserial PRIMARY KEY,
+	route_id bigint NOT NULL,
+	domain text NOT NULL,
+	path_prefix text NOT NULL DEFAULT '',
+	action text NOT NULL,
+	actor text NOT NULL,
+	created_at timestamptz NOT NULL,
+	before text,
+	after text
+);
+
+CREATE INDEX IF NOT EXISTS idx_route_revisions_route_id ON route_revisions (route_id);
+CREATE INDEX IF NOT EXISTS idx_route_revisions_domain ON route_revisions (domain);
@@ -0,0 +1,3 @@
+-- New users get the least access unless a role is given, existing users keep full access
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'viewer';
+UPDATE users SET role = 'admin';
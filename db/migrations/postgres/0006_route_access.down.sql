@@ -0,0 +1,3 @@
+ALTER TABLE routes DROP COLUMN IF EXISTS allowed_groups;
+ALTER TABLE routes DROP COLUMN IF EXISTS allowed_users;
+ALTER TABLE users DROP COLUMN IF EXISTS groups;
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS groups text;
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS allowed_users text;
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS allowed_groups text;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL,
+	credential_id text NOT NULL,
+	name text,
+	credential text NOT NULL,
+	created_at timestamptz NOT NULL,
+	last_used_at timestamptz
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_webauthn_credentials_credential_id ON webauthn_credentials (credential_id);
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials (user_id);
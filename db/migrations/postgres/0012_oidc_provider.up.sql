@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS oidc_clients (
+	id bigserial PRIMARY KEY,
+	client_id text NOT NULL,
+	name text NOT NULL,
+	secret_hash text NOT NULL,
+	redirect_uris text,
+	created_at timestamptz NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_oidc_clients_client_id ON oidc_clients (client_id);
+
+CREATE TABLE IF NOT EXISTS oidc_keys (
+	id text PRIMARY KEY,
+	private_key text NOT NULL,
+	created_at timestamptz NOT NULL
+);
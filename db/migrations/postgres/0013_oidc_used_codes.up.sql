@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS oidc_used_codes (
+	id text PRIMARY KEY,
+	expires_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_oidc_used_codes_expires_at ON oidc_used_codes (expires_at);
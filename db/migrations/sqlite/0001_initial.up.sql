@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS routes (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	domain text,
+	path_prefix text NOT NULL DEFAULT '',
+	target_path text,
+	strip_prefix numeric,
+	targets text,
+	load_balancing text NOT NULL DEFAULT 'round_robin',
+	health_check_path text,
+	health_check_interval integer NOT NULL DEFAULT 10,
+	is_static numeric,
+	enforce_auth numeric
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_routes_domain_path ON routes (domain, path_prefix);
+
+CREATE TABLE IF NOT EXISTS request_logs (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	timestamp datetime,
+	method text,
+	host text,
+	path text,
+	status_code integer,
+	latency_ms integer,
+	remote_addr text
+);
+
+CREATE INDEX IF NOT EXISTS idx_request_logs_timestamp ON request_logs (timestamp);
+CREATE INDEX IF NOT EXISTS idx_request_logs_host ON request_logs (host);
+
+CREATE TABLE IF NOT EXISTS users (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	username text,
+	password text
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users (username);
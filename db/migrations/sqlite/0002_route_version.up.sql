@@ -0,0 +1,7 @@
+-- Bumped on every route change, instances without LISTEN/NOTIFY poll it
+CREATE TABLE IF NOT EXISTS route_version (
+	id integer PRIMARY KEY,
+	version bigint NOT NULL
+);
+
+INSERT INTO route_version (id, version) VALUES (1, 0);
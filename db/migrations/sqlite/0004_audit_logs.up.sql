@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS audit_logs (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	timestamp datetime NOT NULL,
+	actor text NOT NULL,
+	action text NOT NULL,
+	target text,
+	source_ip text,
+	result text NOT NULL,
+	details text
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_logs_timestamp ON audit_logs (timestamp);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_actor ON audit_logs (actor);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_action ON audit_logs (action);
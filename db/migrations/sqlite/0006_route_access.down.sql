@@ -0,0 +1,3 @@
+ALTER TABLE routes DROP COLUMN allowed_groups;
+ALTER TABLE routes DROP COLUMN allowed_users;
+ALTER TABLE users DROP COLUMN groups;
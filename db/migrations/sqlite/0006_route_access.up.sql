@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN groups text;
+ALTER TABLE routes ADD COLUMN allowed_users text;
+ALTER TABLE routes ADD COLUMN allowed_groups text;
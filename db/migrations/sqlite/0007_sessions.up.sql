@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS sessions (
+	id text PRIMARY KEY,
+	user_id integer NOT NULL,
+	username text NOT NULL,
+	created_at datetime NOT NULL,
+	expires_at datetime NOT NULL,
+	source_ip text,
+	user_agent text
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions (expires_at);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	user_id integer NOT NULL,
+	username text NOT NULL,
+	name text NOT NULL,
+	scope text NOT NULL,
+	prefix text NOT NULL,
+	token_hash text NOT NULL,
+	created_at datetime NOT NULL,
+	expires_at datetime,
+	last_used_at datetime
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_tokens_token_hash ON api_tokens (token_hash);
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens (user_id);
@@ -0,0 +1,2 @@
+-- Existing users log in with their local password
+ALTER TABLE users ADD COLUMN source text NOT NULL DEFAULT 'local';
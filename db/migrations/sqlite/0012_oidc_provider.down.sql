@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS oidc_keys;
+DROP TABLE IF EXISTS oidc_clients;
@@ -2,13 +2,47 @@ package db
 
 import "time"
 
+// Load balancing policies for routes with more than one upstream
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastConnections = "least_connections"
+	BalanceRandom           = "random"
+	BalanceIPHash           = "ip_hash"
+)
+
+const DefaultHealthCheckInterval = 10
+
 type Route struct {
-	ID         uint   `gorm:"primaryKey" json:"id"`
-	Domain     string `gorm:"uniqueIndex" json:"domain"`
-	TargetPath string `json:"target_path"`
+	ID          uint   `gorm:"primaryKey" json:"id,omitempty" yaml:"-"`
+	Domain      string `gorm:"uniqueIndex:idx_routes_domain_path" json:"domain" yaml:"domain"`
+	PathPrefix  string `gorm:"uniqueIndex:idx_routes_domain_path;not null;default:''" json:"path_prefix" yaml:"path_prefix,omitempty"`
+	TargetPath  string `json:"target_path" yaml:"target_path"`
+	StripPrefix bool   `json:"strip_prefix" yaml:"strip_prefix,omitempty"`
+	// Additional upstreams next to TargetPath, balanced with LoadBalancing
+	Targets       []string `gorm:"type:text;serializer:json" json:"targets" yaml:"targets,omitempty"`
+	LoadBalancing string   `gorm:"not null;default:'round_robin'" json:"load_balancing" yaml:"load_balancing,omitempty"`
+	// Active health check, disabled while HealthCheckPath is empty
+	HealthCheckPath     string `json:"health_check_path" yaml:"health_check_path,omitempty"`
+	HealthCheckInterval int    `gorm:"not null;default:10" json:"health_check_interval" yaml:"health_check_interval,omitempty"`
 	// UseHTTPS    bool   `json:"use_https"`
-	IsStatic    bool `json:"is_static"`
-	EnforceAuth bool `json:"enforce_auth"`
+	IsStatic    bool `json:"is_static" yaml:"is_static,omitempty"`
+	EnforceAuth bool `json:"enforce_auth" yaml:"enforce_auth,omitempty"`
+	// Restrict an auth enforcing route to these users and members of these groups, everyone is allowed while both are empty
+	AllowedUsers  []string `gorm:"type:text;serializer:json" json:"allowed_users" yaml:"allowed_users,omitempty"`
+	AllowedGroups []string `gorm:"type:text;serializer:json" json:"allowed_groups" yaml:"allowed_groups,omitempty"`
+}
+
+// RouteRevision records one route mutation with the route state before and after it
+type RouteRevision struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	RouteID    uint      `gorm:"index" json:"route_id"`
+	Domain     string    `gorm:"index" json:"domain"`
+	PathPrefix string    `json:"path_prefix"`
+	Action     string    `json:"action"`
+	Actor      string    `json:"actor"`
+	CreatedAt  time.Time `json:"created_at"`
+	Before     *Route    `gorm:"type:text;serializer:json" json:"before"`
+	After      *Route    `gorm:"type:text;serializer:json" json:"after"`
 }
 
 type RequestLog struct {
@@ -22,8 +56,106 @@ type RequestLog struct {
 	RemoteAddr string    `json:"remote_addr"`
 }
 
+// AuditLog records administrative actions like logins and route changes
+type AuditLog struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Timestamp time.Time `gorm:"index" json:"timestamp"`
+	Actor     string    `gorm:"index" json:"actor"`
+	Action    string    `gorm:"index" json:"action"`
+	Target    string    `json:"target"`
+	SourceIP  string    `json:"source_ip"`
+	Result    string    `json:"result"`
+	Details   string    `json:"details,omitempty"`
+}
+
 type User struct {
-	ID       uint   `gorm:"primaryKey"`
-	Username string `gorm:"uniqueIndex"`
-	Password string
+	ID       uint     `gorm:"primaryKey" json:"id"`
+	Username string   `gorm:"uniqueIndex" json:"username"`
+	Password string   `json:"-"`
+	Role     string   `gorm:"default:viewer" json:"role"`
+	Groups   []string `gorm:"type:text;serializer:json" json:"groups"`
+	// How the user logs in, external users have no usable local password
+	Source string `gorm:"default:local" json:"source"`
+	// Second factor, TOTPSecret is kept during enrollment until the first code was verified
+	TOTPSecret    string   `gorm:"column:totp_secret" json:"-"`
+	TOTPEnabled   bool     `gorm:"column:totp_enabled" json:"totp_enabled"`
+	TOTPLastStep  int64    `gorm:"column:totp_last_step" json:"-"`
+	RecoveryCodes []string `gorm:"type:text;serializer:json" json:"-"`
+}
+
+// WebAuthnCredential is a passkey of a user. Credential holds the JSON encoded public key
+// and authenticator state of the WebAuthn library.
+type WebAuthnCredential struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	UserID       uint       `gorm:"index" json:"-"`
+	CredentialID string     `gorm:"uniqueIndex" json:"-"`
+	Name         string     `json:"name"`
+	Credential   string     `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+func (WebAuthnCredential) TableName() string {
+	return "webauthn_credentials"
+}
+
+// Session backs one login, AuthMiddleware only accepts tokens whose session still exists
+type Session struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"index" json:"user_id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+	SourceIP  string    `json:"source_ip"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `gorm:"-" json:"current,omitempty"`
+}
+
+// ApiToken is a long lived credential for automation. Only the hash of the token is stored.
+type ApiToken struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"index" json:"-"`
+	Username   string     `json:"username"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	Prefix     string     `json:"prefix"`
+	TokenHash  string     `gorm:"uniqueIndex" json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// OIDCClient is an application that logs users in with Latios as OpenID provider
+type OIDCClient struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	ClientID     string    `gorm:"uniqueIndex" json:"client_id"`
+	Name         string    `json:"name"`
+	SecretHash   string    `json:"-"`
+	RedirectURIs []string  `gorm:"type:text;serializer:json" json:"redirect_uris"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (OIDCClient) TableName() string {
+	return "oidc_clients"
+}
+
+// OIDCKey is a PEM encoded RSA key for signing ID tokens, ID is the key ID in the JWKS
+type OIDCKey struct {
+	ID         string    `gorm:"primaryKey" json:"id"`
+	PrivateKey string    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (OIDCKey) TableName() string {
+	return "oidc_keys"
+}
+
+// OIDCUsedCode remembers a redeemed authorization code until it would have expired anyway
+type OIDCUsedCode struct {
+	ID        string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+func (OIDCUsedCode) TableName() string {
+	return "oidc_used_codes"
 }
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+const routeChannel = "latios_routes"
+
+// instanceID tells our own notifications apart from those of other replicas
+var instanceID = newInstanceID()
+
+// Last route_version this instance has seen, used by the polling fallback
+var knownRouteVersion atomic.Int64
+
+// Route versions written by this instance that the polling fallback has not seen yet.
+// Postgres notifications carry the instance instead.
+var ownRouteVersions = map[int64]bool{}
+var ownRouteVersionsLock sync.Mutex
+
+type routeNotification struct {
+	Instance string `json:"instance"`
+	Version  int64  `json:"version"`
+}
+
+func newInstanceID() string {
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// routeTransaction runs a change to the routes and bumps the route version in the same
+// transaction, so other instances never see one without the other. Postgres delivers the
+// notification once the transaction commits.
+func routeTransaction(change func(tx *gorm.DB) error) error {
+	var version int64
+	err := Client.Transaction(func(tx *gorm.DB) error {
+		if err := change(tx); err != nil {
+			return err
+		}
+
+		err := tx.Raw("UPDATE route_version SET version = version + 1 WHERE id = 1 RETURNING version").Scan(&version).Error
+		if err != nil {
+			return fmt.Errorf("bump route version: %w", err)
+		}
+		if tx.Dialector.Name() != "postgres" {
+			return nil
+		}
+
+		payload, _ := json.Marshal(routeNotification{Instance: instanceID, Version: version})
+		return tx.Exec("SELECT pg_notify(?, ?)", routeChannel, string(payload)).Error
+	})
+	if err != nil || Client.Dialector.Name() == "postgres" {
+		return err
+	}
+
+	ownRouteVersionsLock.Lock()
+	ownRouteVersions[version] = true
+	ownRouteVersionsLock.Unlock()
+	return nil
+}
+
+// onlyOwnVersions reports whether every version after known up to version was written by
+// this instance, which already has those changes in its cache
+func onlyOwnVersions(known, version int64) bool {
+	ownRouteVersionsLock.Lock()
+	defer ownRouteVersionsLock.Unlock()
+
+	own := version > known && version-known <= int64(len(ownRouteVersions))
+	for v := known + 1; own && v <= version; v++ {
+		own = ownRouteVersions[v]
+	}
+	for v := range ownRouteVersions {
+		if v <= version {
+			delete(ownRouteVersions, v)
+		}
+	}
+	return own
+}
+
+// StartRouteSync keeps the route cache in sync with changes made by other instances.
+// Postgres pushes changes with LISTEN/NOTIFY, sqlite polls the route version every ROUTE_SYNC_INTERVAL seconds.
+func StartRouteSync() {
+	version, err := currentRouteVersion()
+	if err != nil {
+		log.Printf("[SYNC] Failed to read route version: %v", err)
+	}
+	knownRouteVersion.Store(version)
+
+	if Client.Dialector.Name() == "postgres" {
+		log.Printf("[SYNC] Listening for route changes on %s", routeChannel)
+		go listenForRouteChanges()
+		return
+	}
+
+	interval, err := strconv.Atoi(getEnv("ROUTE_SYNC_INTERVAL", "5"))
+	if err != nil || interval < 1 {
+		interval = 5
+	}
+	log.Printf("[SYNC] Polling for route changes every %ds", interval)
+	go pollRouteChanges(time.Duration(interval) * time.Second)
+}
+
+func currentRouteVersion() (int64, error) {
+	var version int64
+	err := Client.Raw("SELECT version FROM route_version WHERE id = 1").Scan(&version).Error
+	return version, err
+}
+
+func reloadFromOtherInstance() {
+	if err := loadRoutesIntoMemory(); err != nil {
+		log.Printf("[SYNC] Failed to reload routes: %v", err)
+		return
+	}
+	log.Printf("[SYNC] Reloaded routes changed by another instance")
+}
+
+func pollRouteChanges(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		version, err := currentRouteVersion()
+		if err != nil {
+			log.Printf("[SYNC] Failed to read route version: %v", err)
+			continue
+		}
+		known := knownRouteVersion.Swap(version)
+		if version != known && !onlyOwnVersions(known, version) {
+			reloadFromOtherInstance()
+		}
+	}
+}
+
+// listenForRouteChanges holds a dedicated connection for LISTEN and reconnects when it drops
+func listenForRouteChanges() {
+	backoff := time.Second
+	for {
+		connected := time.Now()
+		err := listen(context.Background())
+		if time.Since(connected) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("[SYNC] Route listener stopped: %v, reconnecting in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Minute)
+
+		// Changes might have been missed while disconnected
+		reloadFromOtherInstance()
+	}
+}
+
+func listen(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, postgresDSN())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, "LISTEN "+routeChannel); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var change routeNotification
+		if err := json.Unmarshal([]byte(notification.Payload), &change); err != nil {
+			log.Printf("[SYNC] Ignoring invalid notification: %v", err)
+			continue
+		}
+		if change.Instance == instanceID {
+			continue
+		}
+
+		knownRouteVersion.Store(change.Version)
+		reloadFromOtherInstance()
+	}
+}
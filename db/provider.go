@@ -0,0 +1,138 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrOIDCClientNotFound = errors.New("oidc client not found")
+var ErrInvalidClient = errors.New("invalid client credentials")
+var ErrCodeUsed = errors.New("code was already used")
+
+// CreateOIDCClient registers an application for the OpenID provider. The client secret is
+// only returned here, the redirect URIs have to match exactly during login.
+func CreateOIDCClient(name string, redirectURIs []string) (OIDCClient, string, error) {
+	name = strings.TrimSpace(name)
+
+	errs := &ValidationError{}
+	if name == "" || len(name) > 64 {
+		errs.add("name", "must be between 1 and 64 characters")
+	}
+	if len(redirectURIs) == 0 {
+		errs.add("redirect_uris", "at least one redirect URI is required")
+	}
+	for _, redirectURI := range redirectURIs {
+		target, err := url.Parse(redirectURI)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" || target.Fragment != "" {
+			errs.add("redirect_uris", "%q must be an absolute http(s) URL without fragment", redirectURI)
+		}
+	}
+	if len(errs.Errors) > 0 {
+		return OIDCClient{}, "", errs
+	}
+
+	secret := randomHex(32)
+	client := OIDCClient{
+		ClientID:     randomHex(16),
+		Name:         name,
+		SecretHash:   hashSecret(secret),
+		RedirectURIs: redirectURIs,
+		CreatedAt:    time.Now().UTC(),
+	}
+	return client, secret, Client.Create(&client).Error
+}
+
+// OIDCClients lists the registered applications
+func OIDCClients() ([]OIDCClient, error) {
+	clients := []OIDCClient{}
+	err := Client.Order("created_at").Find(&clients).Error
+	return clients, err
+}
+
+// OIDCClientByClientID looks up an application by the client_id it sends
+func OIDCClientByClientID(clientID string) (OIDCClient, error) {
+	var client OIDCClient
+	err := Client.Where("client_id = ?", clientID).First(&client).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return client, ErrOIDCClientNotFound
+	}
+	return client, err
+}
+
+// AuthenticateOIDCClient checks the credentials an application sends to the token endpoint
+func AuthenticateOIDCClient(clientID, secret string) (OIDCClient, error) {
+	client, err := OIDCClientByClientID(clientID)
+	if errors.Is(err, ErrOIDCClientNotFound) {
+		return client, ErrInvalidClient
+	}
+	if err != nil {
+		return client, err
+	}
+	if subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashSecret(secret))) != 1 {
+		return client, ErrInvalidClient
+	}
+	return client, nil
+}
+
+// DeleteOIDCClient removes an application, tokens it already received stay valid until they expire
+func DeleteOIDCClient(id uint) (OIDCClient, error) {
+	var client OIDCClient
+	if err := Client.First(&client, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return client, ErrOIDCClientNotFound
+		}
+		return client, err
+	}
+	return client, Client.Delete(&client).Error
+}
+
+// OIDCKeys lists the signing keys newest first
+func OIDCKeys() ([]OIDCKey, error) {
+	keys := []OIDCKey{}
+	err := Client.Order("created_at DESC").Find(&keys).Error
+	return keys, err
+}
+
+// AddOIDCKey stores a new signing key. Instances that add one at the same time both keep
+// theirs, every stored key is published.
+func AddOIDCKey(id, privateKey string) error {
+	return Client.Create(&OIDCKey{ID: id, PrivateKey: privateKey, CreatedAt: time.Now().UTC()}).Error
+}
+
+// RedeemOIDCCode marks an authorization code as used, it fails with ErrCodeUsed for codes
+// that were redeemed before on any instance. Expired entries are removed on the way.
+func RedeemOIDCCode(id string, expires time.Time) error {
+	if err := Client.Where("expires_at < ?", time.Now().UTC()).Delete(&OIDCUsedCode{}).Error; err != nil {
+		return err
+	}
+
+	result := Client.Clauses(clause.OnConflict{DoNothing: true}).Create(&OIDCUsedCode{ID: id, ExpiresAt: expires.UTC()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrCodeUsed
+	}
+	return nil
+}
+
+func randomHex(size int) string {
+	bytes := make([]byte, size)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// Client secrets are random, a plain hash is enough
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
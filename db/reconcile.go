@@ -0,0 +1,170 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// RouteDocument is the portable form of the route table used by route files
+type RouteDocument struct {
+	Routes []Route `json:"routes" yaml:"routes"`
+}
+
+type RouteChange struct {
+	Action string   `json:"action"`
+	Before *Route   `json:"before,omitempty"`
+	After  *Route   `json:"after,omitempty"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+func (change RouteChange) String() string {
+	route := change.After
+	if route == nil {
+		route = change.Before
+	}
+	name := route.Domain + route.PathPrefix
+
+	switch change.Action {
+	case ChangeCreate:
+		return "+ " + name
+	case ChangeDelete:
+		return "- " + name
+	default:
+		return "~ " + name + " (" + strings.Join(change.Fields, ", ") + ")"
+	}
+}
+
+func routeKey(route Route) string {
+	return route.Domain + "|" + route.PathPrefix
+}
+
+// PlanRoutes compares the desired routes with the database. Routes missing from the desired
+// list are only deleted when prune is set.
+func PlanRoutes(desired []Route, prune bool) ([]RouteChange, error) {
+	errs := &ValidationError{}
+	wanted := make(map[string]Route, len(desired))
+
+	for i, route := range desired {
+		route.ID = 0
+		route.Normalize()
+
+		if err := ValidateRoute(route); err != nil {
+			for _, fieldError := range err.(*ValidationError).Errors {
+				errs.add(fmt.Sprintf("routes[%d].%s", i, fieldError.Field), "%s", fieldError.Message)
+			}
+			continue
+		}
+		if _, ok := wanted[routeKey(route)]; ok {
+			errs.add(fmt.Sprintf("routes[%d].domain", i), "%s%s is defined twice", route.Domain, route.PathPrefix)
+			continue
+		}
+		wanted[routeKey(route)] = route
+	}
+	if len(errs.Errors) > 0 {
+		return nil, errs
+	}
+
+	var current []Route
+	if err := Client.Find(&current).Error; err != nil {
+		return nil, err
+	}
+
+	var changes []RouteChange
+	for _, existing := range current {
+		existing.Normalize()
+		route, ok := wanted[routeKey(existing)]
+		if !ok {
+			if prune {
+				before := existing
+				changes = append(changes, RouteChange{Action: ChangeDelete, Before: &before})
+			}
+			continue
+		}
+		delete(wanted, routeKey(existing))
+
+		route.ID = existing.ID
+		if fields := changedFields(existing, route); len(fields) > 0 {
+			before, after := existing, route
+			changes = append(changes, RouteChange{Action: ChangeUpdate, Before: &before, After: &after, Fields: fields})
+		}
+	}
+
+	for _, route := range wanted {
+		after := route
+		changes = append(changes, RouteChange{Action: ChangeCreate, After: &after})
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].String() < changes[j].String()
+	})
+	return changes, nil
+}
+
+// ApplyRouteChanges writes a plan in one transaction and reloads the route cache
+func ApplyRouteChanges(changes []RouteChange, actor string) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	err := routeTransaction(func(tx *gorm.DB) error {
+		for _, change := range changes {
+			var err error
+			switch change.Action {
+			case ChangeCreate:
+				err = tx.Create(change.After).Error
+			case ChangeUpdate:
+				err = tx.Save(change.After).Error
+			case ChangeDelete:
+				err = tx.Delete(&Route{}, change.Before.ID).Error
+			}
+			if err == nil {
+				err = recordRevision(tx, change.Action, actor, change.Before, change.After)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", change, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return ReloadRoutes()
+}
+
+// ReloadRoutes replaces the route cache with the current database state
+func ReloadRoutes() error {
+	log.Println("[CACHE] Reloading routes from database")
+	return loadRoutesIntoMemory()
+}
+
+// changedFields lists the JSON names of all settings that differ between two routes
+func changedFields(before, after Route) []string {
+	var fields []string
+	beforeValue := reflect.ValueOf(before)
+	afterValue := reflect.ValueOf(after)
+	routeType := beforeValue.Type()
+
+	for i := 0; i < routeType.NumField(); i++ {
+		field := routeType.Field(i)
+		if field.Name == "ID" {
+			continue
+		}
+		if !reflect.DeepEqual(beforeValue.Field(i).Interface(), afterValue.Field(i).Interface()) {
+			fields = append(fields, strings.Split(field.Tag.Get("json"), ",")[0])
+		}
+	}
+	return fields
+}
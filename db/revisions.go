@@ -0,0 +1,101 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const ChangeRestore = "restore"
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// recordRevision stores a route mutation inside the transaction that performs it
+func recordRevision(tx *gorm.DB, action, actor string, before, after *Route) error {
+	route := after
+	if route == nil {
+		route = before
+	}
+
+	revision := RouteRevision{
+		RouteID:    route.ID,
+		Domain:     route.Domain,
+		PathPrefix: route.PathPrefix,
+		Action:     action,
+		Actor:      actor,
+		CreatedAt:  time.Now(),
+		Before:     before,
+		After:      after,
+	}
+	return tx.Create(&revision).Error
+}
+
+// RouteRevisions lists the newest revisions first, optionally only those of one domain
+func RouteRevisions(domain string, limit, offset int) ([]RouteRevision, error) {
+	query := Client.Order("id desc").Limit(limit).Offset(offset)
+	if domain != "" {
+		query = query.Where("domain = ?", domain)
+	}
+
+	var revisions []RouteRevision
+	err := query.Find(&revisions).Error
+	return revisions, err
+}
+
+// RestoreRevision brings a route back to the state recorded in a revision. That is the state
+// after the change, or for deletions the route as it was before it got deleted.
+// A deleted route is recreated with its former ID.
+func RestoreRevision(revisionID uint, actor string) (Route, error) {
+	var restored Route
+	err := routeTransaction(func(tx *gorm.DB) error {
+		var revision RouteRevision
+		if err := tx.First(&revision, revisionID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRevisionNotFound
+			}
+			return err
+		}
+
+		snapshot := revision.After
+		if snapshot == nil {
+			snapshot = revision.Before
+		}
+		if snapshot == nil {
+			return fmt.Errorf("revision %d has no route state", revisionID)
+		}
+		restored = *snapshot
+		restored.ID = revision.RouteID
+
+		if err := ValidateRoute(restored); err != nil {
+			return err
+		}
+		if err := checkRouteConflict(tx, restored); err != nil {
+			return err
+		}
+
+		var current Route
+		err := tx.First(&current, restored.ID).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if err := tx.Create(&restored).Error; err != nil {
+				return err
+			}
+			return recordRevision(tx, ChangeRestore, actor, nil, &restored)
+		case err != nil:
+			return err
+		}
+
+		if err := tx.Save(&restored).Error; err != nil {
+			return err
+		}
+		return recordRevision(tx, ChangeRestore, actor, &current, &restored)
+	})
+	if err != nil {
+		return restored, err
+	}
+
+	AddRouteToCache(restored)
+	return restored, nil
+}
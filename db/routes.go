@@ -0,0 +1,240 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// NormalizePathPrefix brings a route prefix into its stored form: a leading
+// slash, no trailing slash and "" for the catch-all route of a domain.
+func NormalizePathPrefix(prefix string) string {
+	prefix = strings.TrimSpace(prefix)
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+// NormalizeDomain brings a route domain into its stored form, trimmed and lower case
+func NormalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSpace(domain))
+}
+
+// Normalize brings user supplied route settings into their stored form
+func (route *Route) Normalize() {
+	route.Domain = NormalizeDomain(route.Domain)
+	route.PathPrefix = NormalizePathPrefix(route.PathPrefix)
+	route.TargetPath = strings.TrimSpace(route.TargetPath)
+	if route.LoadBalancing == "" {
+		route.LoadBalancing = BalanceRoundRobin
+	}
+	if route.HealthCheckInterval == 0 {
+		route.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if len(route.Targets) == 0 {
+		route.Targets = nil
+	}
+	route.AllowedUsers = normalizeNames(route.AllowedUsers)
+	route.AllowedGroups = normalizeNames(route.AllowedGroups)
+}
+
+// normalizeNames trims, sorts and deduplicates user or group names
+func normalizeNames(names []string) []string {
+	var result []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name != "" && !slices.Contains(result, name) {
+			result = append(result, name)
+		}
+	}
+	slices.Sort(result)
+	return result
+}
+
+// Allows reports whether a user may access the route, routes without allow lists admit every user
+func (route Route) Allows(username string, groups []string) bool {
+	if len(route.AllowedUsers) == 0 && len(route.AllowedGroups) == 0 {
+		return true
+	}
+	if slices.Contains(route.AllowedUsers, username) {
+		return true
+	}
+	for _, group := range groups {
+		if slices.Contains(route.AllowedGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesPath reports whether the request path falls under the route prefix.
+// "/api" matches "/api" and "/api/users" but not "/apis".
+func (route Route) MatchesPath(path string) bool {
+	if route.PathPrefix == "" {
+		return true
+	}
+	return path == route.PathPrefix || strings.HasPrefix(path, route.PathPrefix+"/")
+}
+
+// MatchRoute picks the route with the longest prefix matching the path.
+func MatchRoute(routes []Route, path string) (Route, bool) {
+	var best Route
+	found := false
+	for _, route := range routes {
+		if !route.MatchesPath(path) {
+			continue
+		}
+		if !found || len(route.PathPrefix) > len(best.PathPrefix) {
+			best = route
+			found = true
+		}
+	}
+	return best, found
+}
+
+// Upstreams lists every proxy target of the route, TargetPath first
+func (route Route) Upstreams() []string {
+	upstreams := make([]string, 0, len(route.Targets)+1)
+	seen := make(map[string]bool)
+	for _, target := range append([]string{route.TargetPath}, route.Targets...) {
+		target = strings.TrimSpace(target)
+		if target == "" || seen[target] {
+			continue
+		}
+		seen[target] = true
+		upstreams = append(upstreams, target)
+	}
+	return upstreams
+}
+
+// sortRoutes orders routes of one domain by descending prefix length
+func sortRoutes(routes []Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].PathPrefix) > len(routes[j].PathPrefix)
+	})
+}
+
+var ErrRouteNotFound = errors.New("route not found")
+var ErrRouteConflict = errors.New("route for this domain and path prefix already exists")
+
+// checkRouteConflict makes sure no other route uses the same domain and path prefix
+func checkRouteConflict(tx *gorm.DB, route Route) error {
+	var conflicts int64
+	err := tx.Model(&Route{}).
+		Where("domain = ? AND path_prefix = ? AND id <> ?", route.Domain, route.PathPrefix, route.ID).
+		Count(&conflicts).Error
+	if err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		return ErrRouteConflict
+	}
+	return nil
+}
+
+// RouteByID loads a single route from the database
+func RouteByID(id uint) (Route, error) {
+	var route Route
+	err := Client.First(&route, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return route, ErrRouteNotFound
+	}
+	return route, err
+}
+
+// CreateRoute validates and stores a new route and adds it to the cache
+func CreateRoute(route Route, actor string) (Route, error) {
+	route.ID = 0
+	if err := ValidateRoute(route); err != nil {
+		return route, err
+	}
+
+	err := routeTransaction(func(tx *gorm.DB) error {
+		if err := checkRouteConflict(tx, route); err != nil {
+			return err
+		}
+		if err := tx.Create(&route).Error; err != nil {
+			return err
+		}
+		return recordRevision(tx, ChangeCreate, actor, nil, &route)
+	})
+	if err != nil {
+		return route, err
+	}
+
+	AddRouteToCache(route)
+	return route, nil
+}
+
+// UpdateRoute loads a route, applies the changes, validates and saves it in one transaction.
+// The cache is only refreshed once the transaction committed.
+func UpdateRoute(id uint, actor string, apply func(route *Route) error) (Route, error) {
+	var updated Route
+	err := routeTransaction(func(tx *gorm.DB) error {
+		var route Route
+		if err := tx.First(&route, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRouteNotFound
+			}
+			return err
+		}
+
+		before := route
+		if err := apply(&route); err != nil {
+			return err
+		}
+		route.ID = id
+
+		if err := ValidateRoute(route); err != nil {
+			return err
+		}
+		if err := checkRouteConflict(tx, route); err != nil {
+			return err
+		}
+
+		if err := tx.Save(&route).Error; err != nil {
+			return err
+		}
+		updated = route
+		return recordRevision(tx, ChangeUpdate, actor, &before, &route)
+	})
+	if err != nil {
+		return updated, err
+	}
+
+	AddRouteToCache(updated)
+	return updated, nil
+}
+
+// DeleteRoute removes a route by domain and path prefix and drops it from the cache
+func DeleteRoute(domain, pathPrefix, actor string) error {
+	err := routeTransaction(func(tx *gorm.DB) error {
+		var route Route
+		err := tx.Where("domain = ? AND path_prefix = ?", domain, pathPrefix).First(&route).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrRouteNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&route).Error; err != nil {
+			return err
+		}
+		return recordRevision(tx, ChangeDelete, actor, &route, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	DeleteRouteFromCache(domain, pathPrefix)
+	return nil
+}
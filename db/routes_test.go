@@ -0,0 +1,49 @@
+package db
+
+import "testing"
+
+func TestMatchRoute(t *testing.T) {
+	routes := []Route{
+		{Domain: "app.example.com", PathPrefix: "/api/v1"},
+		{Domain: "app.example.com", PathPrefix: "/api"},
+		{Domain: "app.example.com", PathPrefix: ""},
+	}
+
+	tests := []struct {
+		path       string
+		wantPrefix string
+	}{
+		{"/", ""},
+		{"/index.html", ""},
+		{"/api", "/api"},
+		{"/api/", "/api"},
+		{"/api/users", "/api"},
+		{"/apix", ""},
+		{"/apix/users", ""},
+		{"/api/v1", "/api/v1"},
+		{"/api/v1/users", "/api/v1"},
+		{"/api/v10", "/api"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			route, ok := MatchRoute(routes, test.path)
+			if !ok {
+				t.Fatalf("no route matched %s", test.path)
+			}
+			if route.PathPrefix != test.wantPrefix {
+				t.Errorf("matched prefix %q, want %q", route.PathPrefix, test.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestMatchRouteWithoutCatchAll(t *testing.T) {
+	routes := []Route{{Domain: "app.example.com", PathPrefix: "/api"}}
+
+	for _, path := range []string{"/", "/apix", "/ap", "/other/api"} {
+		if route, ok := MatchRoute(routes, path); ok {
+			t.Errorf("%s matched prefix %q, want no match", path, route.PathPrefix)
+		}
+	}
+}
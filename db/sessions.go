@@ -0,0 +1,133 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How long AuthMiddleware trusts a session lookup before asking the database again.
+// Revocations on other instances take at most this long to apply.
+const sessionCacheTTL = 10 * time.Second
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Time of the last successful lookup per session ID, entries older than sessionCacheTTL are
+// dropped whenever a lookup is stored so revoked and expired IDs do not pile up
+var validSessions = make(map[string]time.Time)
+var validSessionsLock sync.Mutex
+
+func newSessionID() string {
+	bytes := make([]byte, 24)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// CreateSession starts a session for a successful login and drops expired ones
+func CreateSession(user User, sourceIP, userAgent string, lifetime time.Duration) (Session, error) {
+	now := time.Now().UTC()
+	session := Session{
+		ID:        newSessionID(),
+		UserID:    user.ID,
+		Username:  user.Username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+		SourceIP:  sourceIP,
+		UserAgent: userAgent,
+	}
+
+	if err := Client.Where("expires_at < ?", now).Delete(&Session{}).Error; err != nil {
+		return session, err
+	}
+	return session, Client.Create(&session).Error
+}
+
+// SessionValid reports whether a session exists and has not expired
+func SessionValid(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	validSessionsLock.Lock()
+	checked, ok := validSessions[id]
+	validSessionsLock.Unlock()
+	if ok && time.Since(checked) < sessionCacheTTL {
+		return true
+	}
+
+	var count int64
+	err := Client.Model(&Session{}).Where("id = ? AND expires_at > ?", id, time.Now().UTC()).Count(&count).Error
+	if err != nil || count == 0 {
+		forgetSessions(id)
+		return false
+	}
+
+	now := time.Now()
+	validSessionsLock.Lock()
+	for cached, checked := range validSessions {
+		if now.Sub(checked) >= sessionCacheTTL {
+			delete(validSessions, cached)
+		}
+	}
+	validSessions[id] = now
+	validSessionsLock.Unlock()
+	return true
+}
+
+func forgetSessions(ids ...string) {
+	validSessionsLock.Lock()
+	defer validSessionsLock.Unlock()
+	for _, id := range ids {
+		delete(validSessions, id)
+	}
+}
+
+// Sessions lists the active sessions, of one user if username is set
+func Sessions(username string) ([]Session, error) {
+	query := Client.Where("expires_at > ?", time.Now().UTC()).Order("created_at DESC")
+	if username != "" {
+		query = query.Where("username = ?", username)
+	}
+
+	sessions := []Session{}
+	err := query.Find(&sessions).Error
+	return sessions, err
+}
+
+// RevokeSession ends a session, of one user if username is set
+func RevokeSession(id, username string) error {
+	query := Client.Where("id = ?", id)
+	if username != "" {
+		query = query.Where("username = ?", username)
+	}
+
+	result := query.Delete(&Session{})
+	if result.Error != nil {
+		return result.Error
+	}
+	forgetSessions(id)
+	if result.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// revokeUserSessions ends every session of a user except keep
+func revokeUserSessions(tx *gorm.DB, userID uint, keep string) error {
+	var ids []string
+	if err := tx.Model(&Session{}).Where("user_id = ? AND id <> ?", userID, keep).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := tx.Where("id IN ?", ids).Delete(&Session{}).Error; err != nil {
+		return err
+	}
+	forgetSessions(ids...)
+	return nil
+}
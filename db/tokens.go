@@ -0,0 +1,142 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Every token starts with this prefix so leaked tokens are easy to spot and tell apart from session JWTs
+const ApiTokenPrefix = "latios_"
+
+// How often the last use of a token is written, requests in between only read it
+const tokenUseInterval = time.Minute
+
+var ErrTokenNotFound = errors.New("api token not found")
+var ErrInvalidToken = errors.New("invalid or expired api token")
+
+// CreateApiToken issues a token for the user. The scope is the highest role the token acts with
+// and cannot exceed the role of the user. The token itself is only returned here.
+func CreateApiToken(username, name, scope string, expiresAt *time.Time) (ApiToken, string, error) {
+	var token ApiToken
+
+	user, err := userByName(Client, username)
+	if err != nil {
+		return token, "", err
+	}
+
+	name = strings.TrimSpace(name)
+	if scope == "" {
+		scope = RoleViewer
+	}
+	now := time.Now().UTC()
+
+	errs := &ValidationError{}
+	if name == "" || len(name) > 64 {
+		errs.add("name", "must be between 1 and 64 characters")
+	}
+	if _, ok := roleRank[scope]; !ok {
+		errs.add("scope", "must be one of viewer, editor or admin")
+	} else if !HasRole(user.Role, scope) {
+		errs.add("scope", "must not exceed your role %s", user.Role)
+	}
+	if expiresAt != nil && !expiresAt.After(now) {
+		errs.add("expires_at", "must be in the future")
+	}
+	if len(errs.Errors) > 0 {
+		return token, "", errs
+	}
+
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	raw := ApiTokenPrefix + hex.EncodeToString(bytes)
+
+	if expiresAt != nil {
+		utc := expiresAt.UTC()
+		expiresAt = &utc
+	}
+	token = ApiToken{
+		UserID:    user.ID,
+		Username:  user.Username,
+		Name:      name,
+		Scope:     scope,
+		Prefix:    raw[:len(ApiTokenPrefix)+8],
+		TokenHash: hashApiToken(raw),
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	return token, raw, Client.Create(&token).Error
+}
+
+// AuthenticateApiToken returns a valid token and its user and records the use
+func AuthenticateApiToken(raw string) (ApiToken, User, error) {
+	var token ApiToken
+	var user User
+
+	err := Client.Where("token_hash = ?", hashApiToken(raw)).First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return token, user, ErrInvalidToken
+	}
+	if err != nil {
+		return token, user, err
+	}
+
+	now := time.Now().UTC()
+	if token.ExpiresAt != nil && !token.ExpiresAt.After(now) {
+		return token, user, ErrInvalidToken
+	}
+
+	if user, err = findUser(Client, token.UserID); err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			err = ErrInvalidToken
+		}
+		return token, user, err
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > tokenUseInterval {
+		token.LastUsedAt = &now
+		if err := Client.Model(&token).Update("last_used_at", now).Error; err != nil {
+			return token, user, err
+		}
+	}
+	return token, user, nil
+}
+
+// ApiTokens lists the tokens, of one user if username is set
+func ApiTokens(username string) ([]ApiToken, error) {
+	query := Client.Order("created_at DESC")
+	if username != "" {
+		query = query.Where("username = ?", username)
+	}
+
+	tokens := []ApiToken{}
+	err := query.Find(&tokens).Error
+	return tokens, err
+}
+
+// RevokeApiToken deletes a token, of one user if username is set
+func RevokeApiToken(id uint, username string) (ApiToken, error) {
+	var token ApiToken
+	query := Client.Where("id = ?", id)
+	if username != "" {
+		query = query.Where("username = ?", username)
+	}
+	if err := query.First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return token, ErrTokenNotFound
+		}
+		return token, err
+	}
+	return token, Client.Delete(&token).Error
+}
+
+// Tokens have 256 random bits, a plain hash is enough and keeps the lookup cheap
+func hashApiToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,276 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// TOTP as in RFC 6238 with the defaults every authenticator app supports
+const (
+	totpIssuer        = "Latios"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpModulo        = 1_000_000
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var ErrTOTPEnabled = errors.New("two-factor authentication is already enabled")
+var ErrTOTPNotEnrolled = errors.New("two-factor authentication enrollment was not started")
+var ErrInvalidCode = errors.New("invalid authentication code")
+var ErrTooManyAttempts = errors.New("too many invalid authentication codes, try again later")
+
+// Wrong second factor codes in a row before the second factor of a user is locked. The counts
+// are kept per instance, with several instances an attacker gets this many tries on each.
+const (
+	maxSecondFactorFailures = 5
+	secondFactorLockout     = 15 * time.Minute
+)
+
+type secondFactorFailures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+var secondFactorAttempts = map[uint]*secondFactorFailures{}
+var secondFactorAttemptsLock sync.Mutex
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// BeginTOTP stores a new secret for the user and returns it with the otpauth:// URI for
+// authenticator apps. Two-factor authentication stays off until EnableTOTP verified a code.
+func BeginTOTP(username string) (secret, provisioningURI string, err error) {
+	user, err := userByName(Client, username)
+	if err != nil {
+		return "", "", err
+	}
+	if user.TOTPEnabled {
+		return "", "", ErrTOTPEnabled
+	}
+
+	bytes := make([]byte, 20)
+	rand.Read(bytes)
+	secret = totpEncoding.EncodeToString(bytes)
+
+	if err := Client.Model(&user).Update("totp_secret", secret).Error; err != nil {
+		return "", "", err
+	}
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + user.Username)
+	return secret, "otpauth://totp/" + label + "?" + query.Encode(), nil
+}
+
+// EnableTOTP turns on two-factor authentication once a code for the new secret was verified
+// and returns the recovery codes, which are only stored hashed
+func EnableTOTP(username, code string) ([]string, error) {
+	var codes []string
+	err := Client.Transaction(func(tx *gorm.DB) error {
+		user, err := userByName(tx, username)
+		if err != nil {
+			return err
+		}
+		if user.TOTPEnabled {
+			return ErrTOTPEnabled
+		}
+		if user.TOTPSecret == "" {
+			return ErrTOTPNotEnrolled
+		}
+
+		step, ok := matchTOTP(user.TOTPSecret, code, time.Now())
+		if !ok {
+			return ErrInvalidCode
+		}
+
+		hashes := make([]string, recoveryCodeCount)
+		codes = make([]string, recoveryCodeCount)
+		for i := range codes {
+			codes[i] = newRecoveryCode()
+			hashes[i] = hashRecoveryCode(codes[i])
+		}
+
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = hashes
+		return tx.Model(&user).Select("totp_enabled", "totp_last_step", "recovery_codes").Updates(&user).Error
+	})
+	return codes, err
+}
+
+// DisableTOTP turns off two-factor authentication after checking the password. Users of an
+// external identity provider have no password in Latios and confirm with a code instead.
+func DisableTOTP(username, password, code string) error {
+	user, err := userByName(Client, username)
+	if err != nil {
+		return err
+	}
+	if user.Source == SourceLocal {
+		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+			return ErrWrongPassword
+		}
+	} else if user.TOTPEnabled {
+		if err := VerifySecondFactor(user.ID, code); err != nil {
+			return err
+		}
+	}
+
+	return Client.Model(&user).Updates(map[string]any{
+		"totp_secret":    "",
+		"totp_enabled":   false,
+		"totp_last_step": 0,
+		"recovery_codes": nil,
+	}).Error
+}
+
+// VerifySecondFactor accepts a current TOTP code or an unused recovery code. Every code
+// works only once. After maxSecondFactorFailures wrong codes in a row every code is rejected
+// for secondFactorLockout.
+func VerifySecondFactor(userID uint, code string) error {
+	if secondFactorLocked(userID) {
+		return ErrTooManyAttempts
+	}
+
+	err := verifySecondFactor(userID, strings.TrimSpace(code))
+	recordSecondFactor(userID, err)
+	return err
+}
+
+func secondFactorLocked(userID uint) bool {
+	secondFactorAttemptsLock.Lock()
+	defer secondFactorAttemptsLock.Unlock()
+
+	failures, ok := secondFactorAttempts[userID]
+	return ok && time.Now().Before(failures.lockedUntil)
+}
+
+// recordSecondFactor counts wrong codes and forgets them after a valid one
+func recordSecondFactor(userID uint, err error) {
+	secondFactorAttemptsLock.Lock()
+	defer secondFactorAttemptsLock.Unlock()
+
+	if err == nil {
+		delete(secondFactorAttempts, userID)
+		return
+	}
+	if !errors.Is(err, ErrInvalidCode) {
+		return
+	}
+
+	failures, ok := secondFactorAttempts[userID]
+	if !ok || (!failures.lockedUntil.IsZero() && time.Now().After(failures.lockedUntil)) {
+		failures = &secondFactorFailures{}
+		secondFactorAttempts[userID] = failures
+	}
+	failures.count++
+	if failures.count >= maxSecondFactorFailures {
+		failures.lockedUntil = time.Now().Add(secondFactorLockout)
+	}
+}
+
+func verifySecondFactor(userID uint, code string) error {
+	return Client.Transaction(func(tx *gorm.DB) error {
+		user, err := findUser(tx, userID)
+		if err != nil {
+			return err
+		}
+		if !user.TOTPEnabled {
+			return ErrTOTPNotEnrolled
+		}
+
+		if step, ok := matchTOTP(user.TOTPSecret, code, time.Now()); ok {
+			// The condition stops a code from being replayed by a concurrent login
+			result := tx.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return ErrInvalidCode
+			}
+			return nil
+		}
+
+		index := slices.Index(user.RecoveryCodes, hashRecoveryCode(code))
+		if index < 0 {
+			return ErrInvalidCode
+		}
+		user.RecoveryCodes = slices.Delete(user.RecoveryCodes, index, index+1)
+		return tx.Model(&user).Select("recovery_codes").Updates(&user).Error
+	})
+}
+
+func userByName(tx *gorm.DB, username string) (User, error) {
+	var user User
+	if err := tx.Where("username = ?", username).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return user, ErrUserNotFound
+		}
+		return user, err
+	}
+	return user, nil
+}
+
+// matchTOTP checks a code against the time steps around now and returns the matching step
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode computes the HOTP value of RFC 4226 for one time step
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulo)
+}
+
+func newRecoveryCode() string {
+	bytes := make([]byte, 5)
+	rand.Read(bytes)
+	code := hex.EncodeToString(bytes)
+	return code[:5] + "-" + code[5:]
+}
+
+// Recovery codes are random enough for a plain hash
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(code)))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const minPasswordLength = 12
+
+// Roles ordered by privilege, every role includes the permissions of the ones before it
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleAdmin:  3,
+}
+
+var ErrUserNotFound = errors.New("user not found")
+var ErrUserExists = errors.New("username is already taken")
+var ErrLastAdmin = errors.New("the last administrator cannot be deleted or demoted")
+var ErrWrongPassword = errors.New("current password is wrong")
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,64}$`)
+
+// HasRole reports whether role grants at least the permissions of required
+func HasRole(role, required string) bool {
+	return roleRank[role] > 0 && roleRank[role] >= roleRank[required]
+}
+
+// LowerRole returns the less privileged of two roles
+func LowerRole(a, b string) string {
+	if roleRank[a] < roleRank[b] {
+		return a
+	}
+	return b
+}
+
+func validateRole(role string) error {
+	if _, ok := roleRank[role]; !ok {
+		return &ValidationError{Errors: []FieldError{{
+			Field:   "role",
+			Message: "must be one of viewer, editor or admin",
+		}}}
+	}
+	return nil
+}
+
+func validateGroups(groups []string) error {
+	errs := &ValidationError{}
+	validateNames(errs, "groups", groups)
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// lastAdmin reports whether user is the only administrator left
+func lastAdmin(tx *gorm.DB, user User) (bool, error) {
+	if user.Role != RoleAdmin {
+		return false, nil
+	}
+	var admins int64
+	err := tx.Model(&User{}).Where("role = ?", RoleAdmin).Count(&admins).Error
+	return admins <= 1, err
+}
+
+// ValidatePassword enforces the password policy: at least 12 characters with letters
+// and digits, not containing the username
+func ValidatePassword(username, password string) error {
+	errs := &ValidationError{}
+
+	if len(password) < minPasswordLength {
+		errs.add("password", "must be at least %d characters long", minPasswordLength)
+	}
+
+	hasLetter, hasDigit := false, false
+	for _, c := range password {
+		hasLetter = hasLetter || unicode.IsLetter(c)
+		hasDigit = hasDigit || unicode.IsDigit(c)
+	}
+	if !hasLetter || !hasDigit {
+		errs.add("password", "must contain letters and digits")
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		errs.add("password", "must not contain the username")
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hashed), err
+}
+
+func ListUsers() ([]User, error) {
+	var users []User
+	err := Client.Order("username").Find(&users).Error
+	return users, err
+}
+
+// CreateUser validates the username and password policy and stores the bcrypt hash.
+// Users without a role become viewers.
+func CreateUser(username, password, role string, groups []string) (User, error) {
+	username = strings.TrimSpace(username)
+	if role == "" {
+		role = RoleViewer
+	}
+	if err := validateRole(role); err != nil {
+		return User{}, err
+	}
+	if !usernamePattern.MatchString(username) {
+		return User{}, &ValidationError{Errors: []FieldError{{
+			Field:   "username",
+			Message: "must be 3 to 64 characters of letters, digits, dot, dash or underscore",
+		}}}
+	}
+	if err := ValidatePassword(username, password); err != nil {
+		return User{}, err
+	}
+	groups = normalizeNames(groups)
+	if err := validateGroups(groups); err != nil {
+		return User{}, err
+	}
+
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{Username: username, Password: hashed, Role: role, Groups: groups}
+	err = Client.Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&User{}).Where("username = ?", username).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return ErrUserExists
+		}
+		return tx.Create(&user).Error
+	})
+	return user, err
+}
+
+func findUser(tx *gorm.DB, id uint) (User, error) {
+	var user User
+	if err := tx.First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return user, ErrUserNotFound
+		}
+		return user, err
+	}
+	return user, nil
+}
+
+// DeleteUser removes a user unless it is the last administrator
+func DeleteUser(id uint) (User, error) {
+	var user User
+	err := Client.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = findUser(tx, id); err != nil {
+			return err
+		}
+
+		last, err := lastAdmin(tx, user)
+		if err != nil {
+			return err
+		}
+		if last {
+			return ErrLastAdmin
+		}
+
+		if err := revokeUserSessions(tx, user.ID, ""); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&WebAuthnCredential{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&ApiToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	return user, err
+}
+
+// UpdateUser changes the role and groups of a user that are set in one transaction, the last
+// administrator cannot be demoted. The user is logged out to pick up the changes.
+func UpdateUser(id uint, role *string, groups *[]string) (User, error) {
+	if role != nil {
+		if err := validateRole(*role); err != nil {
+			return User{}, err
+		}
+	}
+	var names []string
+	if groups != nil {
+		names = normalizeNames(*groups)
+		if err := validateGroups(names); err != nil {
+			return User{}, err
+		}
+	}
+
+	var user User
+	err := Client.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = findUser(tx, id); err != nil {
+			return err
+		}
+
+		if groups == nil && (role == nil || user.Role == *role) {
+			return nil
+		}
+
+		if role != nil && user.Role != *role {
+			last, err := lastAdmin(tx, user)
+			if err != nil {
+				return err
+			}
+			if last {
+				return ErrLastAdmin
+			}
+			user.Role = *role
+		}
+		if groups != nil {
+			user.Groups = names
+		}
+
+		if err := tx.Model(&user).Select("role", "groups").Updates(&user).Error; err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, user.ID, "")
+	})
+	return user, err
+}
+
+// ChangePassword replaces the password of a user after checking the current one and
+// ends all other sessions of the user
+func ChangePassword(username, currentPassword, newPassword, currentSession string) error {
+	var user User
+	if err := Client.Where("username = ?", username).First(&user).Error; err != nil {
+		return ErrUserNotFound
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword)) != nil {
+		return ErrWrongPassword
+	}
+	if err := ValidatePassword(username, newPassword); err != nil {
+		return err
+	}
+
+	hashed, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	return Client.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("password", hashed).Error; err != nil {
+			return err
+		}
+		return revokeUserSessions(tx, user.ID, currentSession)
+	})
+}
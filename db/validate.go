@@ -0,0 +1,185 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/timsalokat/latios_proxy/config"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every problem found in a route instead of stopping at the first one
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, fieldError := range e.Errors {
+		messages = append(messages, fieldError.Field+": "+fieldError.Message)
+	}
+	return "invalid route: " + strings.Join(messages, ", ")
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+var domainLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+var pathPrefixPattern = regexp.MustCompile(`^(/[A-Za-z0-9._~!$&'()*+,;=:@%-]+)*$`)
+
+var loadBalancingPolicies = map[string]bool{
+	BalanceRoundRobin:       true,
+	BalanceLeastConnections: true,
+	BalanceRandom:           true,
+	BalanceIPHash:           true,
+}
+
+// ValidateRoute checks a normalized route, nil means the route can be stored
+func ValidateRoute(route Route) error {
+	errs := &ValidationError{}
+
+	validateDomain(errs, route.Domain)
+
+	if !pathPrefixPattern.MatchString(route.PathPrefix) ||
+		(route.PathPrefix != "" && path.Clean(route.PathPrefix) != route.PathPrefix) {
+		errs.add("path_prefix", "must be a clean URL path like /api")
+	}
+	if route.StripPrefix && route.PathPrefix == "" {
+		errs.add("strip_prefix", "requires a path prefix")
+	}
+
+	if route.IsStatic {
+		validateStaticDir(errs, route.TargetPath)
+		if len(route.Targets) > 0 {
+			errs.add("targets", "static routes cannot have additional targets")
+		}
+		if route.HealthCheckPath != "" {
+			errs.add("health_check_path", "static routes cannot be health checked")
+		}
+	} else {
+		validateTargetURL(errs, "target_path", route.TargetPath)
+		for i, target := range route.Targets {
+			validateTargetURL(errs, fmt.Sprintf("targets[%d]", i), target)
+		}
+	}
+
+	if !loadBalancingPolicies[route.LoadBalancing] {
+		errs.add("load_balancing", "must be one of round_robin, least_connections, random, ip_hash")
+	}
+
+	if route.HealthCheckPath != "" && !strings.HasPrefix(route.HealthCheckPath, "/") {
+		errs.add("health_check_path", "must start with /")
+	}
+	if route.HealthCheckPath != "" && route.HealthCheckInterval < 1 {
+		errs.add("health_check_interval", "must be at least 1 second")
+	}
+
+	if (len(route.AllowedUsers) > 0 || len(route.AllowedGroups) > 0) && !route.EnforceAuth {
+		errs.add("enforce_auth", "must be enabled to restrict users or groups")
+	}
+	validateNames(errs, "allowed_users", route.AllowedUsers)
+	validateNames(errs, "allowed_groups", route.AllowedGroups)
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateNames checks user and group names against the username rules
+func validateNames(errs *ValidationError, field string, names []string) {
+	for i, name := range names {
+		if !usernamePattern.MatchString(name) {
+			errs.add(fmt.Sprintf("%s[%d]", field, i), "%q is not a valid name", name)
+		}
+	}
+}
+
+// validateDomain checks the hostname syntax and that the certificates for config.DOMAIN cover it
+func validateDomain(errs *ValidationError, domain string) {
+	if domain == "" {
+		errs.add("domain", "is required")
+		return
+	}
+	if len(domain) > 253 {
+		errs.add("domain", "must not be longer than 253 characters")
+		return
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if !domainLabel.MatchString(label) {
+			errs.add("domain", "%q is not a valid hostname", domain)
+			return
+		}
+	}
+
+	// Certificates are issued for the base domain and *.base domain only
+	base := strings.ToLower(config.GetDomain())
+	if base == "" || domain == base {
+		return
+	}
+	subdomain, ok := strings.CutSuffix(domain, "."+base)
+	if !ok || strings.Contains(subdomain, ".") {
+		errs.add("domain", "must be %s or a direct subdomain of it", base)
+	}
+}
+
+func validateTargetURL(errs *ValidationError, field, target string) {
+	if target == "" {
+		errs.add(field, "is required")
+		return
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		errs.add(field, "is not a valid URL")
+		return
+	}
+	if targetURL.Scheme != "http" && targetURL.Scheme != "https" {
+		errs.add(field, "must use the http or https scheme")
+	}
+	if targetURL.Host == "" {
+		errs.add(field, "must contain a host")
+	}
+}
+
+func validateStaticDir(errs *ValidationError, dir string) {
+	if dir == "" {
+		errs.add("target_path", "is required")
+		return
+	}
+	if !filepath.IsAbs(dir) {
+		errs.add("target_path", "must be an absolute directory path")
+		return
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		errs.add("target_path", "directory does not exist")
+		return
+	}
+	if !info.IsDir() {
+		errs.add("target_path", "is not a directory")
+		return
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		errs.add("target_path", "directory is not readable")
+		return
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		errs.add("target_path", "directory is not readable")
+	}
+}
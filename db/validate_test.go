@@ -0,0 +1,120 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/timsalokat/latios_proxy/config"
+)
+
+func TestValidateRoute(t *testing.T) {
+	domain := config.DOMAIN
+	t.Cleanup(func() { config.DOMAIN = domain })
+	config.DOMAIN = "example.com"
+
+	staticDir := t.TempDir()
+	file := filepath.Join(staticDir, "index.html")
+	if err := os.WriteFile(file, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func(change func(route *Route)) Route {
+		route := Route{
+			Domain:        "app.example.com",
+			TargetPath:    "http://app:8080",
+			LoadBalancing: BalanceRoundRobin,
+		}
+		if change != nil {
+			change(&route)
+		}
+		return route
+	}
+
+	tests := []struct {
+		name       string
+		route      Route
+		wantFields []string
+	}{
+		{"proxy route", valid(nil), nil},
+		{"base domain", valid(func(r *Route) { r.Domain = "example.com" }), nil},
+		{"path prefix", valid(func(r *Route) { r.PathPrefix = "/api/v1"; r.StripPrefix = true }), nil},
+		{"several targets", valid(func(r *Route) {
+			r.Targets = []string{"https://app2:8443"}
+			r.LoadBalancing = BalanceIPHash
+		}), nil},
+		{"static route", valid(func(r *Route) { r.IsStatic = true; r.TargetPath = staticDir }), nil},
+		{"health check", valid(func(r *Route) { r.HealthCheckPath = "/healthz"; r.HealthCheckInterval = 10 }), nil},
+		{"restricted", valid(func(r *Route) {
+			r.EnforceAuth = true
+			r.AllowedUsers = []string{"alice"}
+			r.AllowedGroups = []string{"ops"}
+		}), nil},
+
+		{"missing domain", valid(func(r *Route) { r.Domain = "" }), []string{"domain"}},
+		{"invalid hostname", valid(func(r *Route) { r.Domain = "bad_host.example.com" }), []string{"domain"}},
+		{"other base domain", valid(func(r *Route) { r.Domain = "app.example.org" }), []string{"domain"}},
+		{"nested subdomain", valid(func(r *Route) { r.Domain = "a.b.example.com" }), []string{"domain"}},
+		{"trailing slash prefix", valid(func(r *Route) { r.PathPrefix = "/api/" }), []string{"path_prefix"}},
+		{"relative prefix", valid(func(r *Route) { r.PathPrefix = "api" }), []string{"path_prefix"}},
+		{"unclean prefix", valid(func(r *Route) { r.PathPrefix = "/api/../admin" }), []string{"path_prefix"}},
+		{"strip without prefix", valid(func(r *Route) { r.StripPrefix = true }), []string{"strip_prefix"}},
+		{"missing target", valid(func(r *Route) { r.TargetPath = "" }), []string{"target_path"}},
+		{"target scheme", valid(func(r *Route) { r.TargetPath = "ftp://app" }), []string{"target_path"}},
+		{"target host", valid(func(r *Route) { r.TargetPath = "http://" }), []string{"target_path"}},
+		{"bad extra target", valid(func(r *Route) { r.Targets = []string{"http://ok", "ftp://app2"} }), []string{"targets[1]"}},
+		{"relative static dir", valid(func(r *Route) { r.IsStatic = true; r.TargetPath = "www" }), []string{"target_path"}},
+		{"missing static dir", valid(func(r *Route) {
+			r.IsStatic = true
+			r.TargetPath = filepath.Join(staticDir, "missing")
+		}), []string{"target_path"}},
+		{"static file", valid(func(r *Route) { r.IsStatic = true; r.TargetPath = file }), []string{"target_path"}},
+		{"static with targets", valid(func(r *Route) {
+			r.IsStatic = true
+			r.TargetPath = staticDir
+			r.Targets = []string{"http://app2"}
+		}), []string{"targets"}},
+		{"static health check", valid(func(r *Route) {
+			r.IsStatic = true
+			r.TargetPath = staticDir
+			r.HealthCheckPath = "/healthz"
+			r.HealthCheckInterval = 10
+		}), []string{"health_check_path"}},
+		{"unknown policy", valid(func(r *Route) { r.LoadBalancing = "fastest" }), []string{"load_balancing"}},
+		{"relative health check", valid(func(r *Route) { r.HealthCheckPath = "healthz"; r.HealthCheckInterval = 10 }), []string{"health_check_path"}},
+		{"health check interval", valid(func(r *Route) { r.HealthCheckPath = "/healthz" }), []string{"health_check_interval"}},
+		{"users without auth", valid(func(r *Route) { r.AllowedUsers = []string{"alice"} }), []string{"enforce_auth"}},
+		{"invalid group", valid(func(r *Route) {
+			r.EnforceAuth = true
+			r.AllowedGroups = []string{"ops", "bad group"}
+		}), []string{"allowed_groups[1]"}},
+		{"every problem at once", Route{StripPrefix: true, LoadBalancing: "fastest"},
+			[]string{"domain", "strip_prefix", "target_path", "load_balancing"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateRoute(test.route)
+			if test.wantFields == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("got %v, want a validation error", err)
+			}
+			var fields []string
+			for _, fieldError := range validationErr.Errors {
+				fields = append(fields, fieldError.Field)
+			}
+			if !slices.Equal(fields, test.wantFields) {
+				t.Errorf("errors on %v, want %v: %v", fields, test.wantFields, err)
+			}
+		})
+	}
+}
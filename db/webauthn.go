@@ -0,0 +1,62 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrCredentialNotFound = errors.New("passkey not found")
+var ErrCredentialExists = errors.New("passkey is already registered")
+
+// AddWebAuthnCredential stores a newly registered passkey
+func AddWebAuthnCredential(credential *WebAuthnCredential) error {
+	credential.Name = strings.TrimSpace(credential.Name)
+	if credential.Name == "" {
+		credential.Name = "Passkey"
+	}
+	if len(credential.Name) > 64 {
+		return &ValidationError{Errors: []FieldError{{Field: "name", Message: "must not be longer than 64 characters"}}}
+	}
+	credential.CreatedAt = time.Now().UTC()
+
+	return Client.Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&WebAuthnCredential{}).Where("credential_id = ?", credential.CredentialID).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return ErrCredentialExists
+		}
+		return tx.Create(credential).Error
+	})
+}
+
+// WebAuthnCredentials lists the passkeys of a user
+func WebAuthnCredentials(userID uint) ([]WebAuthnCredential, error) {
+	credentials := []WebAuthnCredential{}
+	err := Client.Where("user_id = ?", userID).Order("created_at").Find(&credentials).Error
+	return credentials, err
+}
+
+// UseWebAuthnCredential saves the authenticator state after a login
+func UseWebAuthnCredential(id uint, state string) error {
+	return Client.Model(&WebAuthnCredential{}).Where("id = ?", id).Updates(map[string]any{
+		"credential":   state,
+		"last_used_at": time.Now().UTC(),
+	}).Error
+}
+
+// DeleteWebAuthnCredential removes a passkey of a user
+func DeleteWebAuthnCredential(id, userID uint) error {
+	result := Client.Where("id = ? AND user_id = ?", id, userID).Delete(&WebAuthnCredential{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
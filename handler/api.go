@@ -3,6 +3,9 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
@@ -20,13 +23,51 @@ func RegisterApiHandlers(router *http.ServeMux) {
 	loginLimiter := middleware.NewIPRateLimiter(rate.Every(time.Minute/5), 5)
 	apiLimiter := middleware.NewIPRateLimiter(rate.Limit(10), 20)
 
-	// Define your API routes here
+	// Define your API routes here. requireRole takes the role needed for reading and for changes.
 	apiRoutes := map[string]http.Handler{
-		"/latios-api/health": http.HandlerFunc(HealthCheckHandler),
-		"/latios-api/login":  loginLimiter.RateLimitMiddleware(http.HandlerFunc(LoginHandler)),
-		"/latios-api/routes": apiLimiter.RateLimitMiddleware(http.HandlerFunc(RoutesApiHandler)),
-		"/latios-api/stats":  apiLimiter.RateLimitMiddleware(http.HandlerFunc(StatsApiHandler)),
-		"/latios-api/logs":   apiLimiter.RateLimitMiddleware(http.HandlerFunc(LogsApiHandler)),
+		"/latios-api/health":                               http.HandlerFunc(HealthCheckHandler),
+		"/latios-api/login":                                loginLimiter.RateLimitMiddleware(http.HandlerFunc(LoginHandler)),
+		"/latios-api/login/totp":                           loginLimiter.RateLimitMiddleware(http.HandlerFunc(TOTPLoginHandler)),
+		"/latios-api/oidc/config":                          apiLimiter.RateLimitMiddleware(http.HandlerFunc(OIDCConfigApiHandler)),
+		"/latios-api/oidc/login":                           loginLimiter.RateLimitMiddleware(http.HandlerFunc(OIDCLoginHandler)),
+		"/latios-api/oidc/callback":                        loginLimiter.RateLimitMiddleware(http.HandlerFunc(OIDCCallbackHandler)),
+		providerPath + "/.well-known/openid-configuration": apiLimiter.RateLimitMiddleware(http.HandlerFunc(ProviderDiscoveryHandler)),
+		providerPath + "/jwks":                             apiLimiter.RateLimitMiddleware(http.HandlerFunc(ProviderJWKSHandler)),
+		providerPath + "/authorize":                        apiLimiter.RateLimitMiddleware(http.HandlerFunc(ProviderAuthorizeHandler)),
+		providerPath + "/token":                            apiLimiter.RateLimitMiddleware(http.HandlerFunc(ProviderTokenHandler)),
+		providerPath + "/userinfo":                         apiLimiter.RateLimitMiddleware(http.HandlerFunc(ProviderUserInfoHandler)),
+		"/latios-api/logout":                               apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(LogoutHandler))),
+		"/latios-api/routes":                               apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleEditor, http.HandlerFunc(RoutesApiHandler))),
+		"/latios-api/routes/{id}":                          apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleEditor, http.HandlerFunc(RouteApiHandler))),
+		"/latios-api/routes/health":                        apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(RouteHealthApiHandler))),
+		"/latios-api/routes/export":                        apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(RouteExportApiHandler))),
+		"/latios-api/routes/import":                        apiLimiter.RateLimitMiddleware(requireRole(db.RoleEditor, db.RoleEditor, http.HandlerFunc(RouteImportApiHandler))),
+		"/latios-api/routes/revisions":                     apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(RouteRevisionsApiHandler))),
+		"/latios-api/routes/revisions/{id}/restore":        apiLimiter.RateLimitMiddleware(requireRole(db.RoleEditor, db.RoleEditor, http.HandlerFunc(RestoreRevisionApiHandler))),
+		"/latios-api/stats":                                apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(StatsApiHandler))),
+		"/latios-api/audit":                                apiLimiter.RateLimitMiddleware(requireRole(db.RoleAdmin, db.RoleAdmin, http.HandlerFunc(AuditApiHandler))),
+		"/latios-api/users":                                apiLimiter.RateLimitMiddleware(requireRole(db.RoleAdmin, db.RoleAdmin, http.HandlerFunc(UsersApiHandler))),
+		"/latios-api/users/{id}":                           apiLimiter.RateLimitMiddleware(requireRole(db.RoleAdmin, db.RoleAdmin, http.HandlerFunc(UserApiHandler))),
+		"/latios-api/me/password":                          loginLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(PasswordApiHandler))),
+		"/latios-api/me/sessions":                          apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(MySessionsApiHandler))),
+		"/latios-api/me/sessions/{id}":                     apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(MySessionApiHandler))),
+		"/latios-api/me/totp":                              apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(TOTPApiHandler))),
+		"/latios-api/me/totp/verify":                       apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(TOTPVerifyApiHandler))),
+		"/latios-api/me/tokens":                            apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(MyTokensApiHandler))),
+		"/latios-api/me/tokens/{id}":                       apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(MyTokenApiHandler))),
+		"/latios-api/sessions":                             apiLimiter.RateLimitMiddleware(requireRole(db.RoleAdmin, db.RoleAdmin, http.HandlerFunc(SessionsApiHandler))),
+		"/latios-api/sessions/{id}":                        apiLimiter.RateLimitMiddleware(requireRole(db.RoleAdmin, db.RoleAdmin, http.HandlerFunc(SessionApiHandler))),
+		"/latios-api/tokens":                               apiLimiter.RateLimitMiddleware(requireRole(db.RoleAdmin, db.RoleAdmin, http.HandlerFunc(TokensApiHandler))),
+		"/latios-api/tokens/{id}":                          apiLimiter.RateLimitMiddleware(requireRole(db.RoleAdmin, db.RoleAdmin, http.HandlerFunc(TokenApiHandler))),
+		"/latios-api/oidc-clients":                         apiLimiter.RateLimitMiddleware(requireRole(db.RoleAdmin, db.RoleAdmin, http.HandlerFunc(OIDCClientsApiHandler))),
+		"/latios-api/oidc-clients/{id}":                    apiLimiter.RateLimitMiddleware(requireRole(db.RoleAdmin, db.RoleAdmin, http.HandlerFunc(OIDCClientApiHandler))),
+		"/latios-api/webauthn/register/begin":              apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(WebAuthnRegisterBeginApiHandler))),
+		"/latios-api/webauthn/register/finish":             apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(WebAuthnRegisterFinishApiHandler))),
+		"/latios-api/webauthn/login/begin":                 loginLimiter.RateLimitMiddleware(http.HandlerFunc(WebAuthnLoginBeginApiHandler)),
+		"/latios-api/webauthn/login/finish":                loginLimiter.RateLimitMiddleware(http.HandlerFunc(WebAuthnLoginFinishApiHandler)),
+		"/latios-api/webauthn/credentials":                 apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(WebAuthnCredentialsApiHandler))),
+		"/latios-api/webauthn/credentials/{id}":            apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(WebAuthnCredentialApiHandler))),
+		"/latios-api/logs":                                 apiLimiter.RateLimitMiddleware(requireRole(db.RoleViewer, db.RoleViewer, http.HandlerFunc(LogsApiHandler))),
 	}
 
 	for path, handler := range apiRoutes {
@@ -44,20 +85,20 @@ func RoutesApiHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Should retrieve all routes
 	case http.MethodGet:
-		println("Received GET request")
+		log.Printf("[API] Received GET request")
 
 		var routes []db.Route
 		result := db.Client.Find(&routes)
 
 		if result.Error != nil {
-			println("Error fetching routes from DB:", result.Error.Error())
-			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+			log.Printf("[API] Error fetching routes from DB: %v", result.Error)
+			writeApiError(w, result.Error)
 			return
 		}
 
-		println("Fetched routes count:", len(routes))
+		log.Printf("[API] Fetched routes count: %d", len(routes))
 		if err := json.NewEncoder(w).Encode(routes); err != nil {
-			println("Error encoding response:", err.Error())
+			log.Printf("[API] Error encoding response: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -65,61 +106,178 @@ func RoutesApiHandler(w http.ResponseWriter, r *http.Request) {
 	// Create a new route
 	case http.MethodPost:
 
-		println("Received POST request")
+		log.Printf("[API] Received POST request")
 		var route db.Route
 
 		if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
-			println("Error decoding request body:", err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Printf("[API] Error decoding request body: %v", err)
+			writeApiError(w, errBadRequest{err})
 			return
 		}
 
-		println("Decoded route:", route.Domain)
-		result := db.Client.Create(&route)
-		if result.Error != nil {
-			println("Error creating route in DB:", result.Error.Error())
-			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		route.Normalize()
+
+		log.Printf("[API] Decoded route: %s", route.Domain+route.PathPrefix)
+		route, err := db.CreateRoute(route, actorName(r))
+		audit(r, db.AuditRouteCreate, route.Domain+route.PathPrefix, err)
+		if err != nil {
+			log.Printf("[API] Error creating route: %v", err)
+			writeApiError(w, err)
 			return
 		}
 
-		db.AddRouteToCache(route)
-
-		println("Created route:", route.Domain)
+		log.Printf("[API] Created route: %s", route.Domain+route.PathPrefix)
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(route)
 
 	// Delete route
 	case http.MethodDelete:
-		println("Received DELETE request")
+		log.Printf("[API] Received DELETE request")
 		type DeleteBody struct {
-			Domain string
+			Domain     string
+			PathPrefix string `json:"path_prefix"`
 		}
 
 		var delBody DeleteBody
 		if err := json.NewDecoder(r.Body).Decode(&delBody); err != nil {
-			println("Error decoding request body:", err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Printf("[API] Error decoding request body: %v", err)
+			writeApiError(w, errBadRequest{err})
 			return
 		}
 
-		println("Decoded route for deletion:", delBody.Domain)
-		result := db.Client.Where("domain = ?", delBody.Domain).Delete(&db.Route{})
-		if result.Error != nil {
-			println("Error deleting route in DB:", result.Error.Error())
-			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		delBody.Domain = db.NormalizeDomain(delBody.Domain)
+		delBody.PathPrefix = db.NormalizePathPrefix(delBody.PathPrefix)
+
+		log.Printf("[API] Decoded route for deletion: %s", delBody.Domain+delBody.PathPrefix)
+		err := db.DeleteRoute(delBody.Domain, delBody.PathPrefix, actorName(r))
+		audit(r, db.AuditRouteDelete, delBody.Domain+delBody.PathPrefix, err)
+		if err != nil {
+			log.Printf("[API] Error deleting route: %v", err)
+			writeApiError(w, err)
 			return
 		}
 
-		db.DeleteRouteFromCache(delBody.Domain)
-
-		println("Deleted route:", delBody.Domain)
+		log.Printf("[API] Deleted route: %s", delBody.Domain+delBody.PathPrefix)
 		w.WriteHeader(http.StatusOK)
 
 	default:
-		println("Received unsupported method:", r.Method)
+		log.Printf("[API] Received unsupported method: %s", r.Method)
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// RouteApiHandler reads and updates a single route by its ID
+func RouteApiHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "id", Message: "invalid route id"})
+		return
+	}
+
+	switch r.Method {
+
+	case http.MethodGet:
+		route, err := db.RouteByID(uint(id))
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(route)
+
+	// PUT replaces all settings, PATCH only the fields present in the body
+	case http.MethodPut, http.MethodPatch:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeApiError(w, errBadRequest{err})
+			return
+		}
+
+		route, err := db.UpdateRoute(uint(id), actorName(r), func(route *db.Route) error {
+			if r.Method == http.MethodPut {
+				*route = db.Route{}
+			}
+			if err := json.Unmarshal(body, route); err != nil {
+				return errBadRequest{err}
+			}
+			route.Normalize()
+			return nil
+		})
+
+		target := route.Domain + route.PathPrefix
+		if target == "" {
+			target = fmt.Sprintf("route %d", id)
+		}
+		audit(r, db.AuditRouteUpdate, target, err)
+		if err != nil {
+			log.Printf("[API] Error updating route %d: %v", id, err)
+			writeApiError(w, err)
+			return
+		}
+
+		log.Printf("[API] Updated route %d: %s%s", route.ID, route.Domain, route.PathPrefix)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(route)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// errBadRequest marks errors caused by the request body
+type errBadRequest struct {
+	err error
+}
+
+func (e errBadRequest) Error() string {
+	return e.err.Error()
+}
+
+func writeErrors(w http.ResponseWriter, status int, errs ...db.FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(db.ValidationError{Errors: errs})
+}
+
+// writeApiError maps store errors to structured JSON responses
+func writeApiError(w http.ResponseWriter, err error) {
+	var validationErr *db.ValidationError
+	var badRequest errBadRequest
+
+	switch {
+	case errors.As(err, &validationErr):
+		writeErrors(w, http.StatusBadRequest, validationErr.Errors...)
+	case errors.As(err, &badRequest):
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "body", Message: "invalid JSON: " + badRequest.Error()})
+	case errors.Is(err, db.ErrRouteNotFound), errors.Is(err, db.ErrRevisionNotFound):
+		writeErrors(w, http.StatusNotFound, db.FieldError{Field: "id", Message: err.Error()})
+	case errors.Is(err, db.ErrRouteConflict):
+		writeErrors(w, http.StatusConflict, db.FieldError{Field: "domain", Message: err.Error()})
+	case errors.Is(err, db.ErrUserNotFound):
+		writeErrors(w, http.StatusNotFound, db.FieldError{Field: "id", Message: err.Error()})
+	case errors.Is(err, db.ErrUserExists):
+		writeErrors(w, http.StatusConflict, db.FieldError{Field: "username", Message: err.Error()})
+	case errors.Is(err, db.ErrLastAdmin):
+		writeErrors(w, http.StatusConflict, db.FieldError{Field: "id", Message: err.Error()})
+	case errors.Is(err, db.ErrSessionNotFound), errors.Is(err, db.ErrCredentialNotFound), errors.Is(err, db.ErrTokenNotFound), errors.Is(err, db.ErrOIDCClientNotFound):
+		writeErrors(w, http.StatusNotFound, db.FieldError{Field: "id", Message: err.Error()})
+	case errors.Is(err, db.ErrCredentialExists):
+		writeErrors(w, http.StatusConflict, db.FieldError{Field: "credential", Message: err.Error()})
+	case errors.Is(err, db.ErrTOTPEnabled), errors.Is(err, db.ErrTOTPNotEnrolled):
+		writeErrors(w, http.StatusConflict, db.FieldError{Field: "totp", Message: err.Error()})
+	case errors.Is(err, db.ErrInvalidCode):
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "code", Message: err.Error()})
+	case errors.Is(err, db.ErrTooManyAttempts):
+		writeErrors(w, http.StatusTooManyRequests, db.FieldError{Field: "code", Message: err.Error()})
+	case errors.Is(err, db.ErrWrongPassword):
+		writeErrors(w, http.StatusForbidden, db.FieldError{Field: "current_password", Message: err.Error()})
+	default:
+		writeErrors(w, http.StatusInternalServerError, db.FieldError{Message: "internal error"})
+	}
+}
+
 func StatsApiHandler(w http.ResponseWriter, r *http.Request) {
 	thirtyDaysAgo := time.Now().AddDate(0, 0, -30)
 
@@ -140,7 +298,7 @@ func StatsApiHandler(w http.ResponseWriter, r *http.Request) {
 			COUNT(CASE WHEN status_code >= 500 THEN 1 END) as server_error_count,
 			COUNT(CASE WHEN status_code >= 400 AND status_code < 500 AND status_code != 404 THEN 1 END) as client_error_count,
 			COUNT(CASE WHEN status_code = 404 THEN 1 END) as not_found_count,
-			COALESCE(AVG(latency_ms), 0) as avg_latency_ms
+			COALESCE(AVG(latency_ms), 0) as avg_latency
 		`).
 		Scan(&stats).Error
 
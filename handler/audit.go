@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/timsalokat/latios_proxy/db"
+	"github.com/timsalokat/latios_proxy/middleware"
+)
+
+// audit records an action of the authenticated user, a non nil error marks it as failed
+func audit(r *http.Request, action, target string, err error) {
+	auditAs(r, actorName(r), action, target, err)
+}
+
+func auditAs(r *http.Request, actor, action, target string, err error) {
+	entry := db.AuditLog{
+		Actor:    actor,
+		Action:   action,
+		Target:   target,
+		SourceIP: middleware.ClientIP(r),
+		Result:   db.AuditSuccess,
+	}
+	if err != nil {
+		entry.Result = db.AuditFailure
+		entry.Details = err.Error()
+	}
+	db.RecordAudit(entry)
+}
+
+// AuditApiHandler lists audit entries filtered by actor, action, result and an RFC 3339 since/until range
+func AuditApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := db.AuditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Result: query.Get("result"),
+	}
+
+	for field, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		value := query.Get(field)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeErrors(w, http.StatusBadRequest, db.FieldError{Field: field, Message: "must be an RFC 3339 timestamp"})
+			return
+		}
+		*target = parsed
+	}
+
+	limit := 100
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page <= 0 {
+		page = 1
+	}
+
+	logs, err := db.AuditLogs(filter, limit, (page-1)*limit)
+	if err != nil {
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logs)
+}
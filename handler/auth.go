@@ -3,24 +3,40 @@ package handler
 import (
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/timsalokat/latios_proxy/db"
+	"github.com/timsalokat/latios_proxy/middleware"
 	"golang.org/x/crypto/bcrypt"
 )
 
+//go:embed templates/403.html
+var forbiddenHTML string
+var forbiddenTemplate = template.Must(template.New("403").Parse(forbiddenHTML))
+
 var authCookieName = "latios_auth"
 var jwtKey = []byte(os.Getenv("LATIOS_SECRET_KEY"))
 
+const sessionLifetime = 24 * time.Hour
+
+// Time to enter the second factor after the password was accepted
+const totpChallengeLifetime = 5 * time.Minute
+
 type Claims struct {
-	Username string `json:"username"`
+	Username string   `json:"username"`
+	Role     string   `json:"role"`
+	Groups   []string `json:"groups,omitempty"`
+	// Set when the request was authenticated with an API token instead of a session
+	TokenID uint `json:"-"`
 	jwt.RegisteredClaims
 }
 
@@ -30,30 +46,86 @@ type LoginRequest struct {
 	Redirect string `json:"redirect"`
 }
 
-// Simple check if route requires security
-func routeRequiresAuth(host string) bool {
-	route, err := db.GetRoute(host)
-	if err != nil {
-		return true
+// LoginResponse either carries the page to continue on or, for users with two-factor
+// authentication, the challenge to send to /latios-api/login/totp with the code
+type LoginResponse struct {
+	Redirect     string `json:"redirect,omitempty"`
+	TOTPRequired bool   `json:"totp_required,omitempty"`
+	Challenge    string `json:"challenge,omitempty"`
+}
+
+type TOTPLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+	Redirect  string `json:"redirect"`
+}
+
+// totpChallenge proves that the password of the subject was checked
+type totpChallenge struct {
+	Purpose string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+// Authenticator checks a username and password against one user store
+type Authenticator interface {
+	Name() string
+	Authenticate(username, password string) (db.User, error)
+}
+
+// Authenticators are tried in order, the first one accepting the credentials wins. Local
+// users come last so they can still log in when the directory is unreachable.
+var authenticators = configuredAuthenticators()
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+func configuredAuthenticators() []Authenticator {
+	if ldapEnabled() {
+		return []Authenticator{ldapAuthenticator{}, localAuthenticator{}}
 	}
-	return route.EnforceAuth
+	return []Authenticator{localAuthenticator{}}
 }
 
-func validateCredentials(username, password string) bool {
+func validateCredentials(username, password string) (db.User, bool) {
+	for _, authenticator := range authenticators {
+		user, err := authenticator.Authenticate(username, password)
+		if err == nil {
+			return user, true
+		}
+		if !errors.Is(err, errInvalidCredentials) {
+			log.Printf("[AUTH] %s authentication of %s failed: %v", authenticator.Name(), username, err)
+		}
+	}
+	return db.User{}, false
+}
+
+// localAuthenticator checks the password hashes in the users table
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string { return "Local" }
+
+func (localAuthenticator) Authenticate(username, password string) (db.User, error) {
 	var user db.User
 	if err := db.Client.Where("username = ?", username).First(&user).Error; err != nil {
-		return false
+		return user, errInvalidCredentials
+	}
+	// External users log in through their identity provider only
+	if user.Source != db.SourceLocal {
+		return user, errInvalidCredentials
 	}
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
-	return err == nil
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return user, errInvalidCredentials
+	}
+	return user, nil
 }
 
-func generateToken(username string) (string, error) {
-	exporationTime := time.Now().Add(24 * time.Hour)
+func generateToken(user db.User, session db.Session) (string, error) {
 	claims := &Claims{
-		Username: username,
+		Username: user.Username,
+		Role:     user.Role,
+		Groups:   user.Groups,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(exporationTime),
+			ID:        session.ID,
+			ExpiresAt: jwt.NewNumericDate(session.ExpiresAt),
 		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -68,6 +140,10 @@ func AuthMiddleware(next http.Handler) http.Handler {
 		if strings.HasPrefix(r.URL.Path, "/latios/assets/") ||
 			r.URL.Path == "/latios/login" ||
 			r.URL.Path == "/latios-api/login" ||
+			r.URL.Path == "/latios-api/login/totp" ||
+			strings.HasPrefix(r.URL.Path, "/latios-api/webauthn/login/") ||
+			strings.HasPrefix(r.URL.Path, "/latios-api/oidc/") ||
+			strings.HasPrefix(r.URL.Path, providerPath+"/") ||
 			r.URL.Path == "/latios-api/health" {
 			next.ServeHTTP(w, r)
 			return
@@ -75,43 +151,81 @@ func AuthMiddleware(next http.Handler) http.Handler {
 
 		log.Printf("[AUTH] Checking authentication for host: %s path: %s", r.Host, r.URL.Path)
 
-		if !strings.HasPrefix(r.URL.Path, "/latios") && !routeRequiresAuth(r.Host) {
-			log.Printf("[AUTH] Route does not require auth, proceeding")
-			next.ServeHTTP(w, r)
-			return
-		}
+		if !strings.HasPrefix(r.URL.Path, "/latios") {
+			// Unknown hosts require auth, the proxy handler reuses the lookup
+			route, found := lookupRoute(r)
+			r = withRoute(r, route, found)
 
-		tokenString := ""
-		if cookie, err := r.Cookie(authCookieName); err == nil {
-			tokenString = cookie.Value
-		} else {
-			header := r.Header.Get("Authorization")
-			if strings.HasPrefix(header, "Bearer ") {
-				tokenString = strings.TrimPrefix(header, "Bearer ")
+			if found && !route.EnforceAuth {
+				log.Printf("[AUTH] Route does not require auth, proceeding")
+				next.ServeHTTP(w, r)
+				return
 			}
 		}
 
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, ok := authenticate(r)
+		if !ok {
 			if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/latios-api/") {
-				loginURL := fmt.Sprintf("/latios/login?redirect=%s", url.QueryEscape(r.URL.String()))
-				http.Redirect(w, r, loginURL, http.StatusFound)
+				gotoLogin(w, r)
 			} else {
 				http.Error(w, "Unatuhorized", http.StatusUnauthorized)
 			}
 			return
 		}
 
+		if !strings.HasPrefix(r.URL.Path, "/latios") {
+			if route, found := lookupRoute(r); found && !route.Allows(claims.Username, claims.Groups) {
+				log.Printf("[AUTH] User %s is not allowed on %s%s", claims.Username, route.Domain, route.PathPrefix)
+				serveForbidden(w, r, claims)
+				return
+			}
+		}
+
 		log.Printf("[AUTH] Authenticated user, proceeding")
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withUser(r, claims))
 
 	})
 }
 
+// authenticate reads the user from an API token in the Authorization header or from the
+// session JWT in the cookie or header
+func authenticate(r *http.Request) (*Claims, bool) {
+	header := r.Header.Get("Authorization")
+	if raw, ok := strings.CutPrefix(header, "Bearer "); ok && strings.HasPrefix(raw, db.ApiTokenPrefix) {
+		token, user, err := db.AuthenticateApiToken(raw)
+		if err != nil {
+			log.Printf("[AUTH] Rejected api token: %v", err)
+			return nil, false
+		}
+
+		log.Printf("[AUTH] Api token %s of user %s used", token.Name, user.Username)
+		return &Claims{
+			Username: user.Username,
+			Role:     db.LowerRole(user.Role, token.Scope),
+			Groups:   user.Groups,
+			TokenID:  token.ID,
+		}, true
+	}
+
+	tokenString := ""
+	if cookie, err := r.Cookie(authCookieName); err == nil {
+		tokenString = cookie.Value
+	} else if raw, ok := strings.CutPrefix(header, "Bearer "); ok {
+		tokenString = raw
+	}
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+
+	// Tokens issued before roles and sessions existed have to be renewed by logging in again
+	if err != nil || !token.Valid || claims.Role == "" || !db.SessionValid(claims.ID) {
+		return nil, false
+	}
+	return claims, true
+}
+
 // Handle the login page GET and POST
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -127,44 +241,234 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 		username := req.Username
 		password := req.Password
-		redirect := req.Redirect
+		redirect := safeRedirect(req.Redirect)
 
-		isSecure := r.TLS != nil
+		user, ok := validateCredentials(username, password)
+		if !ok {
+			log.Printf("[AUTH] Invalid credentials for user: %s", username)
+			auditAs(r, username, db.AuditLogin, r.Host, errors.New("invalid credentials"))
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
 
-		if validateCredentials(username, password) {
-			// Set cookie
-			token, err := generateToken(username)
+		if user.TOTPEnabled {
+			challenge, err := generateChallenge(user)
 			if err != nil {
-				log.Printf("[AUTH] Couldnt create token for user: %s", username)
-				gotoLogin(w, r)
+				log.Printf("[AUTH] Couldnt create challenge for user: %s", username)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
 			}
 
-			http.SetCookie(w, &http.Cookie{
-				Name:     authCookieName,
-				Value:    token,
-				Path:     "/",
-				HttpOnly: true,
-				Secure:   isSecure,
-				Expires:  time.Now().Add(24 * time.Hour),
-				SameSite: http.SameSiteLaxMode, // prevents csrf attacks (not sure if this option doesnt deny my sso)
-			})
-
-			log.Printf("[AUTH] User %s logged in successfully, redirecting to %s", username, redirect)
-			if redirect == "" {
-				redirect = "/"
-			}
-			http.Redirect(w, r, redirect, http.StatusFound)
-
-		} else {
-			log.Printf("[AUTH] Invalid credentials for user: %s", username)
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			log.Printf("[AUTH] User %s needs a second factor", username)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(LoginResponse{TOTPRequired: true, Challenge: challenge})
+			return
 		}
+
+		startSession(w, r, user, redirect)
+
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// TOTPLoginHandler completes the login of users with two-factor authentication
+func TOTPLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TOTPLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("[AUTH] Error decoding login json: %v", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := parseChallenge(req.Challenge)
+	if err != nil {
+		http.Error(w, "Login expired, please start again", http.StatusUnauthorized)
+		return
+	}
+
+	var user db.User
+	if err := db.Client.First(&user, userID).Error; err != nil {
+		http.Error(w, "Login expired, please start again", http.StatusUnauthorized)
+		return
+	}
+
+	if err := db.VerifySecondFactor(user.ID, req.Code); err != nil {
+		log.Printf("[AUTH] Invalid second factor for user: %s", user.Username)
+		auditAs(r, user.Username, db.AuditLogin, r.Host, fmt.Errorf("second factor: %w", err))
+		if errors.Is(err, db.ErrTooManyAttempts) {
+			http.Error(w, "Too many invalid codes, try again later", http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	startSession(w, r, user, safeRedirect(req.Redirect))
+}
+
+// LogoutHandler ends the current session and removes the cookie
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := currentUser(r)
+	if claims == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err := db.RevokeSession(claims.ID, "")
+	if errors.Is(err, db.ErrSessionNotFound) {
+		err = nil
+	}
+	audit(r, db.AuditLogout, r.Host, err)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    "",
+		Path:     "/",
+		Domain:   cookieDomain(r),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		MaxAge:   -1,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	log.Printf("[AUTH] User %s logged out", claims.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startSession records the login, hands out the session cookie and tells the login page where to go
+func startSession(w http.ResponseWriter, r *http.Request, user db.User, redirect string) {
+	if err := issueSession(w, r, user); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// The login page navigates itself, following a redirect to another subdomain would fail in fetch
+	log.Printf("[AUTH] User %s logged in successfully, redirecting to %s", user.Username, redirect)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{Redirect: redirect})
+}
+
+// issueSession creates a session for the user and sets the session cookie
+func issueSession(w http.ResponseWriter, r *http.Request, user db.User) error {
+	session, err := db.CreateSession(user, middleware.ClientIP(r), r.UserAgent(), sessionLifetime)
+	if err != nil {
+		log.Printf("[AUTH] Couldnt create session for user %s: %v", user.Username, err)
+		return err
+	}
+
+	// Set cookie
+	token, err := generateToken(user, session)
+	if err != nil {
+		log.Printf("[AUTH] Couldnt create token for user: %s", user.Username)
+		return err
+	}
+
+	auditAs(r, user.Username, db.AuditLogin, r.Host, nil)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    token,
+		Path:     "/",
+		Domain:   cookieDomain(r),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		Expires:  session.ExpiresAt,
+		SameSite: http.SameSiteLaxMode, // prevents csrf attacks, subdomains of the cookie domain count as same site
+	})
+	return nil
+}
+
+func generateChallenge(user db.User) (string, error) {
+	claims := &totpChallenge{
+		Purpose: "totp",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(totpChallengeLifetime)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
+// parseChallenge returns the ID of the user who passed the password check
+func parseChallenge(challenge string) (uint, error) {
+	claims := &totpChallenge{}
+	token, err := jwt.ParseWithClaims(challenge, claims, func(t *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil || !token.Valid || claims.Purpose != "totp" {
+		return 0, errors.New("invalid challenge")
+	}
+
+	id, err := strconv.ParseUint(claims.Subject, 10, 64)
+	return uint(id), err
+}
+
+func serveForbidden(w http.ResponseWriter, r *http.Request, claims *Claims) {
+	w.WriteHeader(http.StatusForbidden)
+	data := struct {
+		Host     string
+		User     string
+		Redirect string
+	}{
+		Host:     r.Host,
+		User:     claims.Username,
+		Redirect: r.URL.String(),
+	}
+	forbiddenTemplate.Execute(w, data)
+}
+
+// rejectApiToken answers 403 for requests made with an API token. Passkeys and second factors
+// belong to the person, a leaked token must not be able to add, replace or remove them.
+func rejectApiToken(w http.ResponseWriter, r *http.Request) bool {
+	if currentUser(r).TokenID == 0 {
+		return false
+	}
+	writeErrors(w, http.StatusForbidden, db.FieldError{Field: "token", Message: "api tokens cannot change login credentials"})
+	return true
+}
+
+// requireRole rejects users whose role is below read for GET requests or below write for everything else
+func requireRole(read, write string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			required = read
+		}
+
+		claims := currentUser(r)
+		if claims == nil || !db.HasRole(claims.Role, required) {
+			log.Printf("[AUTH] User %s with role %q needs role %s for %s %s", actorName(r), currentRole(claims), required, r.Method, r.URL.Path)
+			writeErrors(w, http.StatusForbidden, db.FieldError{Field: "role", Message: "requires role " + required})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func currentRole(claims *Claims) string {
+	if claims == nil {
+		return ""
+	}
+	return claims.Role
+}
+
 func gotoLogin(w http.ResponseWriter, r *http.Request) {
-	loginURL := fmt.Sprintf("/latios/login?redirect=%s", url.QueryEscape(r.URL.String()))
-	http.Redirect(w, r, loginURL, http.StatusFound)
+	http.Redirect(w, r, loginURL(r), http.StatusFound)
 }
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/timsalokat/latios_proxy/db"
+	"github.com/timsalokat/latios_proxy/middleware"
+)
+
+type upstream struct {
+	name   string
+	target *url.URL
+	proxy  *httputil.ReverseProxy
+	active atomic.Int64
+}
+
+// serve proxies the request and keeps track of the open connections for least_connections
+func (u *upstream) serve(w http.ResponseWriter, r *http.Request) {
+	u.active.Add(1)
+	defer u.active.Add(-1)
+	u.proxy.ServeHTTP(w, r)
+}
+
+type balancer struct {
+	// signature of the route settings the balancer was built from
+	signature string
+	routeID   uint
+	policy    string
+	upstreams []*upstream
+	counter   atomic.Uint64
+}
+
+// Precompiled balancers per route ID, rebuilt whenever the route cache changes
+var balancers = make(map[uint]*balancer)
+var balancerLock sync.RWMutex
+
+func balancerSignature(route db.Route) string {
+	return route.LoadBalancing + "|" + strings.Join(route.Upstreams(), ",")
+}
+
+// InitProxies compiles the reverse proxies of all cached routes and keeps them in sync with the cache
+func InitProxies() {
+	log.Println("[PROXY] Compiling route proxies...")
+	db.OnRoutesChanged(compileBalancers)
+	compileBalancers()
+}
+
+// compileBalancers rebuilds the balancer map, balancers of unchanged routes keep their state
+func compileBalancers() {
+	routes := db.CachedRoutes()
+
+	balancerLock.Lock()
+	defer balancerLock.Unlock()
+
+	compiled := make(map[uint]*balancer, len(routes))
+	for _, route := range routes {
+		if route.IsStatic {
+			continue
+		}
+
+		signature := balancerSignature(route)
+		if b, ok := balancers[route.ID]; ok && b.signature == signature {
+			compiled[route.ID] = b
+			continue
+		}
+
+		b, err := newBalancer(route)
+		if err != nil {
+			log.Printf("%s%v", logPrefix, err)
+			continue
+		}
+		compiled[route.ID] = b
+	}
+	balancers = compiled
+}
+
+// getBalancer returns the precompiled balancer of a route
+func getBalancer(route db.Route) (*balancer, error) {
+	balancerLock.RLock()
+	b, ok := balancers[route.ID]
+	balancerLock.RUnlock()
+
+	if ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("no proxy compiled for route %s%s", route.Domain, route.PathPrefix)
+}
+
+func newBalancer(route db.Route) (*balancer, error) {
+	targets := route.Upstreams()
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("route %s%s has no targets", route.Domain, route.PathPrefix)
+	}
+
+	b := &balancer{signature: balancerSignature(route), routeID: route.ID, policy: route.LoadBalancing}
+	for _, target := range targets {
+		targetURL, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("bad target %s: %w", target, err)
+		}
+		b.upstreams = append(b.upstreams, &upstream{
+			name:   target,
+			target: targetURL,
+			proxy:  newUpstreamProxy(targetURL),
+		})
+	}
+	return b, nil
+}
+
+// healthy returns the upstreams that were not ejected by the health checker
+func (b *balancer) healthy() []*upstream {
+	upstreams := make([]*upstream, 0, len(b.upstreams))
+	for _, u := range b.upstreams {
+		if isTargetHealthy(b.routeID, u.name) {
+			upstreams = append(upstreams, u)
+		}
+	}
+	return upstreams
+}
+
+// next picks the upstream for a request according to the route policy,
+// nil if every upstream is unhealthy
+func (b *balancer) next(r *http.Request) *upstream {
+	upstreams := b.healthy()
+	if len(upstreams) <= 1 {
+		if len(upstreams) == 0 {
+			return nil
+		}
+		return upstreams[0]
+	}
+
+	switch b.policy {
+	case db.BalanceLeastConnections:
+		best := upstreams[0]
+		for _, u := range upstreams[1:] {
+			if u.active.Load() < best.active.Load() {
+				best = u
+			}
+		}
+		return best
+
+	case db.BalanceRandom:
+		return upstreams[rand.IntN(len(upstreams))]
+
+	case db.BalanceIPHash:
+		// Behind TRUSTED_PROXIES every request comes from the proxy, hash the client behind it
+		hash := fnv.New32a()
+		hash.Write([]byte(middleware.ClientIP(r)))
+		return upstreams[hash.Sum32()%uint32(len(upstreams))]
+
+	default:
+		index := b.counter.Add(1) - 1
+		return upstreams[index%uint64(len(upstreams))]
+	}
+}
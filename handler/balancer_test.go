@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"github.com/timsalokat/latios_proxy/config"
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+var balancerTargets = []string{"http://a.internal", "http://b.internal", "http://c.internal"}
+
+func newTestBalancer(t *testing.T, policy string) *balancer {
+	t.Helper()
+	b, err := newBalancer(db.Route{
+		ID:            42,
+		Domain:        "app.example.com",
+		TargetPath:    balancerTargets[0],
+		Targets:       balancerTargets[1:],
+		LoadBalancing: policy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// markDown takes targets of a route out of rotation like failed health checks do
+func markDown(t *testing.T, routeID uint, targets ...string) {
+	t.Helper()
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	for _, target := range targets {
+		healthStates[healthKey{routeID, target}] = &TargetHealth{Target: target, Healthy: false}
+	}
+	t.Cleanup(func() {
+		healthLock.Lock()
+		defer healthLock.Unlock()
+		for _, target := range targets {
+			delete(healthStates, healthKey{routeID, target})
+		}
+	})
+}
+
+func requestFrom(remoteAddr string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+func TestBalancerNext(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		setup  func(b *balancer)
+		check  func(t *testing.T, b *balancer)
+	}{
+		{
+			name:   "round robin cycles through the targets",
+			policy: db.BalanceRoundRobin,
+			check: func(t *testing.T, b *balancer) {
+				for i := 0; i < 6; i++ {
+					want := balancerTargets[i%len(balancerTargets)]
+					if got := b.next(requestFrom("10.0.0.1:1234")).name; got != want {
+						t.Fatalf("request %d went to %s, want %s", i, got, want)
+					}
+				}
+			},
+		},
+		{
+			name:   "least connections picks the least busy target",
+			policy: db.BalanceLeastConnections,
+			setup: func(b *balancer) {
+				b.upstreams[0].active.Store(3)
+				b.upstreams[1].active.Store(1)
+				b.upstreams[2].active.Store(2)
+			},
+			check: func(t *testing.T, b *balancer) {
+				if got := b.next(requestFrom("10.0.0.1:1234")).name; got != balancerTargets[1] {
+					t.Fatalf("request went to %s, want %s", got, balancerTargets[1])
+				}
+			},
+		},
+		{
+			name:   "random stays within the targets",
+			policy: db.BalanceRandom,
+			check: func(t *testing.T, b *balancer) {
+				seen := make(map[string]bool)
+				for i := 0; i < 100; i++ {
+					seen[b.next(requestFrom("10.0.0.1:1234")).name] = true
+				}
+				for name := range seen {
+					if name != balancerTargets[0] && name != balancerTargets[1] && name != balancerTargets[2] {
+						t.Fatalf("request went to unknown target %s", name)
+					}
+				}
+				if len(seen) < 2 {
+					t.Fatalf("100 requests all went to one target")
+				}
+			},
+		},
+		{
+			name:   "ip hash keeps a client on one target",
+			policy: db.BalanceIPHash,
+			check: func(t *testing.T, b *balancer) {
+				first := b.next(requestFrom("10.0.0.1:1234")).name
+				for port := 1235; port < 1245; port++ {
+					req := requestFrom("10.0.0.1:" + strconv.Itoa(port))
+					if got := b.next(req).name; got != first {
+						t.Fatalf("client moved from %s to %s", first, got)
+					}
+				}
+
+				// Without TRUSTED_PROXIES the client cannot pick its target through X-Forwarded-For
+				for _, forwarded := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"} {
+					req := requestFrom("10.0.0.1:1234")
+					req.Header.Set("X-Forwarded-For", forwarded)
+					if got := b.next(req).name; got != first {
+						t.Fatalf("X-Forwarded-For %s moved the client from %s to %s", forwarded, first, got)
+					}
+				}
+			},
+		},
+		{
+			name:   "ip hash spreads the clients behind a trusted proxy",
+			policy: db.BalanceIPHash,
+			check: func(t *testing.T, b *balancer) {
+				trusted := config.TRUSTED_PROXIES
+				t.Cleanup(func() { config.TRUSTED_PROXIES = trusted })
+				config.TRUSTED_PROXIES = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+				seen := make(map[string]bool)
+				for i := 1; i <= 20; i++ {
+					client := "192.0.2." + strconv.Itoa(i)
+					req := requestFrom("10.0.0.1:1234")
+					req.Header.Set("X-Forwarded-For", client)
+					first := b.next(req).name
+					seen[first] = true
+
+					req = requestFrom("10.0.0.1:4321")
+					req.Header.Set("X-Forwarded-For", client)
+					if got := b.next(req).name; got != first {
+						t.Fatalf("client %s moved from %s to %s", client, first, got)
+					}
+				}
+				if len(seen) < 2 {
+					t.Fatalf("20 clients behind the proxy all went to one target")
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBalancer(t, test.policy)
+			if test.setup != nil {
+				test.setup(b)
+			}
+			test.check(t, b)
+		})
+	}
+}
+
+func TestBalancerSkipsDownTargets(t *testing.T) {
+	policies := []string{db.BalanceRoundRobin, db.BalanceLeastConnections, db.BalanceRandom, db.BalanceIPHash}
+
+	for _, policy := range policies {
+		t.Run(policy, func(t *testing.T) {
+			b := newTestBalancer(t, policy)
+			b.upstreams[0].active.Store(1)
+			b.upstreams[1].active.Store(5)
+			b.upstreams[2].active.Store(5)
+			markDown(t, b.routeID, balancerTargets[0])
+
+			for i := 0; i < 20; i++ {
+				u := b.next(requestFrom("10.0.0." + strconv.Itoa(i) + ":1234"))
+				if u == nil {
+					t.Fatalf("no target picked with two healthy ones")
+				}
+				if u.name == balancerTargets[0] {
+					t.Fatalf("request went to the down target %s", u.name)
+				}
+			}
+
+			markDown(t, b.routeID, balancerTargets[1:]...)
+			if u := b.next(requestFrom("10.0.0.1:1234")); u != nil {
+				t.Fatalf("request went to %s with every target down", u.name)
+			}
+		})
+	}
+}
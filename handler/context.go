@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+type contextKey int
+
+const (
+	routeContextKey contextKey = iota
+	userContextKey
+)
+
+type routeLookup struct {
+	route db.Route
+	found bool
+}
+
+// lookupRoute resolves the route of a request once, the result is reused by later handlers
+func lookupRoute(r *http.Request) (db.Route, bool) {
+	if lookup, ok := r.Context().Value(routeContextKey).(routeLookup); ok {
+		return lookup.route, lookup.found
+	}
+
+	route, err := db.GetRoute(r.Host, r.URL.Path)
+	return route, err == nil
+}
+
+// withRoute stores the resolved route in the request context
+func withRoute(r *http.Request, route db.Route, found bool) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeContextKey, routeLookup{route, found}))
+}
+
+// withUser stores the claims of the authenticated user in the request context
+func withUser(r *http.Request, claims *Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, claims))
+}
+
+// currentUser returns the authenticated user, nil for anonymous requests
+func currentUser(r *http.Request) *Claims {
+	claims, _ := r.Context().Value(userContextKey).(*Claims)
+	return claims
+}
+
+// actorName names the user responsible for a change in revisions and logs
+func actorName(r *http.Request) string {
+	if claims := currentUser(r); claims != nil {
+		return claims.Username
+	}
+	return "anonymous"
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+// Consecutive failed probes before a target is taken out of rotation
+const unhealthyThreshold = 2
+
+const defaultHealthCheckInterval = db.DefaultHealthCheckInterval * time.Second
+
+type TargetHealth struct {
+	Target    string    `json:"target"`
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+	failures  int
+}
+
+type RouteHealth struct {
+	RouteID    uint           `json:"route_id"`
+	Domain     string         `json:"domain"`
+	PathPrefix string         `json:"path_prefix"`
+	Targets    []TargetHealth `json:"targets"`
+}
+
+type healthKey struct {
+	routeID uint
+	target  string
+}
+
+var healthStates = make(map[healthKey]*TargetHealth)
+var healthLock sync.RWMutex
+
+var lastHealthCheck = make(map[uint]time.Time)
+
+var healthClient = &http.Client{
+	Timeout: 5 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// isTargetHealthy reports the last known state, targets without checks count as healthy
+func isTargetHealthy(routeID uint, target string) bool {
+	healthLock.RLock()
+	defer healthLock.RUnlock()
+
+	state, ok := healthStates[healthKey{routeID, target}]
+	return !ok || state.Healthy
+}
+
+// StartHealthChecker probes the targets of every route with a health check path in the background
+func StartHealthChecker() {
+	log.Println("[HEALTH] Starting upstream health checker...")
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			runHealthChecks()
+		}
+	}()
+}
+
+func runHealthChecks() {
+	routes := db.CachedRoutes()
+	active := make(map[uint]bool)
+
+	for _, route := range routes {
+		if route.IsStatic || route.HealthCheckPath == "" {
+			continue
+		}
+		active[route.ID] = true
+
+		interval := time.Duration(route.HealthCheckInterval) * time.Second
+		if interval <= 0 {
+			interval = defaultHealthCheckInterval
+		}
+		if time.Since(lastHealthCheck[route.ID]) < interval {
+			continue
+		}
+		lastHealthCheck[route.ID] = time.Now()
+
+		for _, target := range route.Upstreams() {
+			go checkTarget(route, target)
+		}
+	}
+
+	pruneHealthStates(active)
+}
+
+func checkTarget(route db.Route, target string) {
+	probeURL := strings.TrimRight(target, "/") + "/" + strings.TrimLeft(route.HealthCheckPath, "/")
+
+	err := probe(probeURL)
+
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	key := healthKey{route.ID, target}
+	state, ok := healthStates[key]
+	if !ok {
+		state = &TargetHealth{Target: target, Healthy: true}
+		healthStates[key] = state
+	}
+	state.LastCheck = time.Now()
+
+	if err == nil {
+		if !state.Healthy {
+			log.Printf("[HEALTH] Target %s of %s%s is healthy again", target, route.Domain, route.PathPrefix)
+		}
+		state.Healthy = true
+		state.LastError = ""
+		state.failures = 0
+		return
+	}
+
+	state.LastError = err.Error()
+	state.failures++
+	if state.Healthy && state.failures >= unhealthyThreshold {
+		log.Printf("[HEALTH] Target %s of %s%s is unhealthy: %v", target, route.Domain, route.PathPrefix, err)
+		state.Healthy = false
+	}
+}
+
+func probe(probeURL string) error {
+	resp, err := healthClient.Get(probeURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// pruneHealthStates forgets routes that were deleted or had their checks disabled
+func pruneHealthStates(active map[uint]bool) {
+	for routeID := range lastHealthCheck {
+		if !active[routeID] {
+			delete(lastHealthCheck, routeID)
+		}
+	}
+
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	for key := range healthStates {
+		if !active[key.routeID] {
+			delete(healthStates, key)
+		}
+	}
+}
+
+func RouteHealthApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result := []RouteHealth{}
+	for _, route := range db.CachedRoutes() {
+		if route.IsStatic || route.HealthCheckPath == "" {
+			continue
+		}
+
+		routeHealth := RouteHealth{
+			RouteID:    route.ID,
+			Domain:     route.Domain,
+			PathPrefix: route.PathPrefix,
+		}
+
+		healthLock.RLock()
+		for _, target := range route.Upstreams() {
+			state, ok := healthStates[healthKey{route.ID, target}]
+			if !ok {
+				routeHealth.Targets = append(routeHealth.Targets, TargetHealth{Target: target, Healthy: true})
+				continue
+			}
+			routeHealth.Targets = append(routeHealth.Targets, *state)
+		}
+		healthLock.RUnlock()
+
+		result = append(result, routeHealth)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+// setupTestDB migrates a fresh sqlite database and configures the domains of setupDomains
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	t.Setenv("DB_DRIVER", "sqlite")
+	t.Setenv("DB_PATH", t.TempDir()+"/latios.db")
+
+	db.Connect()
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.Client.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	setupDomains(t)
+	jwtKey = []byte("test secret")
+}
+
+func createTestUser(t *testing.T, username, role string) db.User {
+	t.Helper()
+	user, err := db.CreateUser(username, "correct horse 42", role, nil)
+	if err != nil {
+		t.Fatalf("create user %s: %v", username, err)
+	}
+	return user
+}
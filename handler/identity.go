@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/timsalokat/latios_proxy/config"
+)
+
+// Headers telling upstreams of auth enforcing routes who the user is. Upstreams can check
+// the signature or the token with IDENTITY_SECRET, without a secret the headers are sent unsigned.
+var (
+	identityUserHeader      = config.GetEnv("IDENTITY_HEADER_USER", "X-Latios-User")
+	identityGroupsHeader    = config.GetEnv("IDENTITY_HEADER_GROUPS", "X-Latios-Groups")
+	identitySignatureHeader = config.GetEnv("IDENTITY_HEADER_SIGNATURE", "X-Latios-Signature")
+	identityTokenHeader     = config.GetEnv("IDENTITY_HEADER_TOKEN", "X-Latios-Token")
+	identityKey             = []byte(os.Getenv("IDENTITY_SECRET"))
+	identityTokenEnabled    = os.Getenv("IDENTITY_TOKEN") == "true"
+)
+
+const identityTokenLifetime = time.Minute
+
+type IdentityClaims struct {
+	Groups []string `json:"groups,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// setIdentityHeaders removes client supplied identity headers and adds those of the authenticated user
+func setIdentityHeaders(req *http.Request) {
+	for _, header := range []string{identityUserHeader, identityGroupsHeader, identitySignatureHeader, identityTokenHeader} {
+		req.Header.Del(header)
+	}
+
+	claims := currentUser(req)
+	if claims == nil {
+		return
+	}
+
+	groups := strings.Join(claims.Groups, ",")
+	req.Header.Set(identityUserHeader, claims.Username)
+	req.Header.Set(identityGroupsHeader, groups)
+
+	if len(identityKey) == 0 {
+		return
+	}
+
+	route, _ := lookupRoute(req)
+	req.Header.Set(identitySignatureHeader, signIdentity(claims.Username, groups, req.Host, route.Domain+route.PathPrefix, time.Now()))
+
+	if identityTokenEnabled {
+		token, err := identityToken(claims, req.Host)
+		if err != nil {
+			log.Printf("%sCouldnt create identity token for %s: %v", logPrefix, claims.Username, err)
+			return
+		}
+		req.Header.Set(identityTokenHeader, token)
+	}
+}
+
+// signIdentity returns "t=<unix time>,v1=<hex HMAC-SHA256 of user\ngroups\nhost\nroute\ntime>".
+// The host and route keep upstreams from accepting headers replayed from another route.
+func signIdentity(username, groups, host, route string, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	mac := hmac.New(sha256.New, identityKey)
+	mac.Write([]byte(username + "\n" + groups + "\n" + host + "\n" + route + "\n" + timestamp))
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// identityToken issues a short lived JWT for the upstream on host
+func identityToken(claims *Claims, host string) (string, error) {
+	now := time.Now()
+	identity := &IdentityClaims{
+		Groups: claims.Groups,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "latios",
+			Subject:   claims.Username,
+			Audience:  jwt.ClaimStrings{host},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(identityTokenLifetime)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, identity)
+	return token.SignedString(identityKey)
+}
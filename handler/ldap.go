@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/timsalokat/latios_proxy/config"
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+// Login with directory accounts, enabled by setting LDAP_URL and LDAP_BASE_DN. Filters use
+// %s for the escaped username or, in the group filter, the DN of the user.
+var (
+	ldapURL               = os.Getenv("LDAP_URL")
+	ldapStartTLS          = os.Getenv("LDAP_START_TLS") == "true"
+	ldapBindDN            = os.Getenv("LDAP_BIND_DN")
+	ldapBindPassword      = os.Getenv("LDAP_BIND_PASSWORD")
+	ldapBaseDN            = os.Getenv("LDAP_BASE_DN")
+	ldapUserFilter        = config.GetEnv("LDAP_USER_FILTER", "(uid=%s)")
+	ldapUsernameAttribute = config.GetEnv("LDAP_USERNAME_ATTRIBUTE", "uid")
+	ldapGroupBaseDN       = config.GetEnv("LDAP_GROUP_BASE_DN", ldapBaseDN)
+	ldapGroupFilter       = config.GetEnv("LDAP_GROUP_FILTER", "(|(member=%s)(uniqueMember=%s))")
+	ldapGroupAttribute    = config.GetEnv("LDAP_GROUP_ATTRIBUTE", "cn")
+	ldapAdminGroups       = splitList(os.Getenv("LDAP_ADMIN_GROUPS"))
+	ldapEditorGroups      = splitList(os.Getenv("LDAP_EDITOR_GROUPS"))
+)
+
+// Limit for connecting to and every request against the directory
+const ldapTimeout = 5 * time.Second
+
+func ldapEnabled() bool {
+	return ldapURL != "" && ldapBaseDN != ""
+}
+
+// ldapAuthenticator finds the user with the service account, checks the password with a
+// bind as the user and maps the groups the user is a member of
+type ldapAuthenticator struct{}
+
+func (ldapAuthenticator) Name() string { return "LDAP" }
+
+func (ldapAuthenticator) Authenticate(username, password string) (db.User, error) {
+	// An empty password would be an unauthenticated bind, which servers accept
+	if password == "" {
+		return db.User{}, errInvalidCredentials
+	}
+
+	conn, err := ldapConnect()
+	if err != nil {
+		return db.User{}, err
+	}
+	defer conn.Close()
+
+	if err := ldapServiceBind(conn); err != nil {
+		return db.User{}, fmt.Errorf("service bind: %w", err)
+	}
+
+	entry, err := ldapFindUser(conn, username)
+	if err != nil {
+		return db.User{}, err
+	}
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return db.User{}, errInvalidCredentials
+		}
+		return db.User{}, fmt.Errorf("user bind: %w", err)
+	}
+
+	// Users may not be allowed to read groups, search them as the service account again
+	if err := ldapServiceBind(conn); err != nil {
+		return db.User{}, fmt.Errorf("service bind: %w", err)
+	}
+	groups, err := ldapGroups(conn, entry.DN)
+	if err != nil {
+		return db.User{}, err
+	}
+
+	name := entry.GetAttributeValue(ldapUsernameAttribute)
+	if name == "" {
+		name = username
+	}
+	return db.SyncExternalUser(db.SourceLDAP, name, groupRole(groups, ldapAdminGroups, ldapEditorGroups), groups)
+}
+
+func ldapConnect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(ldapURL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if ldapStartTLS {
+		host := ""
+		if parsed, err := url.Parse(ldapURL); err == nil {
+			host = parsed.Hostname()
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("start tls: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// ldapServiceBind binds as LDAP_BIND_DN, without it searches run anonymously
+func ldapServiceBind(conn *ldap.Conn) error {
+	if ldapBindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(ldapBindDN, ldapBindPassword)
+}
+
+func ldapFindUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	filter := strings.ReplaceAll(ldapUserFilter, "%s", ldap.EscapeFilter(username))
+	request := ldap.NewSearchRequest(ldapBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout.Seconds()), false, filter, []string{ldapUsernameAttribute}, nil)
+
+	result, err := conn.Search(request)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("filter %s matches more than one entry", filter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("user search: %w", err)
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, errInvalidCredentials
+	case 1:
+		return result.Entries[0], nil
+	default:
+		return nil, fmt.Errorf("filter %s matches more than one entry", filter)
+	}
+}
+
+func ldapGroups(conn *ldap.Conn, userDN string) ([]string, error) {
+	if ldapGroupFilter == "" {
+		return nil, nil
+	}
+
+	filter := strings.ReplaceAll(ldapGroupFilter, "%s", ldap.EscapeFilter(userDN))
+	request := ldap.NewSearchRequest(ldapGroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, int(ldapTimeout.Seconds()), false, filter, []string{ldapGroupAttribute}, nil)
+
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, fmt.Errorf("group search: %w", err)
+	}
+
+	var groups []string
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.GetAttributeValues(ldapGroupAttribute)...)
+	}
+	return groups, nil
+}
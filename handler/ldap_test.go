@@ -0,0 +1,422 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+const (
+	ldapTestServiceDN       = "cn=latios,dc=example,dc=com"
+	ldapTestServicePassword = "service secret"
+)
+
+// ldapTestEntry is one entry of the fake directory, password is only set for accounts that can bind
+type ldapTestEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// fakeDirectory is an in-process LDAP server that answers simple binds and searches with
+// equality, presence, and and or filters. It records binds and search filters.
+type fakeDirectory struct {
+	listener net.Listener
+
+	lock    sync.Mutex
+	entries []ldapTestEntry
+	binds   []string // DNs of all bind requests, empty for anonymous binds
+	filters []string
+}
+
+func newFakeDirectory(t *testing.T) *fakeDirectory {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := &fakeDirectory{listener: listener, entries: []ldapTestEntry{
+		{dn: ldapTestServiceDN, password: ldapTestServicePassword},
+		ldapTestUser("alice"),
+		ldapTestUser("bob"),
+		ldapTestUser("carol"),
+		ldapTestGroup("ops", "alice"),
+		ldapTestGroup("dev", "alice", "bob"),
+	}}
+	go directory.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	// Point the login at the fake directory
+	url, startTLS, bindDN, bindPassword := ldapURL, ldapStartTLS, ldapBindDN, ldapBindPassword
+	baseDN, groupBaseDN := ldapBaseDN, ldapGroupBaseDN
+	adminGroups, editorGroups := ldapAdminGroups, ldapEditorGroups
+	t.Cleanup(func() {
+		ldapURL, ldapStartTLS, ldapBindDN, ldapBindPassword = url, startTLS, bindDN, bindPassword
+		ldapBaseDN, ldapGroupBaseDN = baseDN, groupBaseDN
+		ldapAdminGroups, ldapEditorGroups = adminGroups, editorGroups
+	})
+	ldapURL, ldapStartTLS = "ldap://"+listener.Addr().String(), false
+	ldapBindDN, ldapBindPassword = ldapTestServiceDN, ldapTestServicePassword
+	ldapBaseDN, ldapGroupBaseDN = "dc=example,dc=com", "ou=groups,dc=example,dc=com"
+	ldapAdminGroups, ldapEditorGroups = []string{"ops"}, []string{"dev"}
+
+	return directory
+}
+
+func ldapTestUser(name string) ldapTestEntry {
+	return ldapTestEntry{
+		dn:         "uid=" + name + ",ou=people,dc=example,dc=com",
+		password:   name + " secret",
+		attributes: map[string][]string{"objectClass": {"person"}, "uid": {name}},
+	}
+}
+
+func ldapTestGroup(name string, members ...string) ldapTestEntry {
+	var dns []string
+	for _, member := range members {
+		dns = append(dns, ldapTestUser(member).dn)
+	}
+	return ldapTestEntry{
+		dn:         "cn=" + name + ",ou=groups,dc=example,dc=com",
+		attributes: map[string][]string{"objectClass": {"groupOfNames"}, "cn": {name}, "member": dns},
+	}
+}
+
+// setGroups replaces the members of a group
+func (d *fakeDirectory) setGroups(name string, members ...string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for i, entry := range d.entries {
+		if entry.dn == ldapTestGroup(name).dn {
+			d.entries[i] = ldapTestGroup(name, members...)
+		}
+	}
+}
+
+func (d *fakeDirectory) recorded() (binds, filters []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return slices.Clone(d.binds), slices.Clone(d.filters)
+}
+
+func (d *fakeDirectory) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		go d.handle(conn)
+	}
+}
+
+func (d *fakeDirectory) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			code := d.bind(op.Children[1].Data.String(), op.Children[2].Data.String())
+			d.reply(conn, id, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			for _, entry := range d.search(op) {
+				d.write(conn, id, entry)
+			}
+			d.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		default:
+			// Unbind and everything else ends the connection
+			return
+		}
+	}
+}
+
+func (d *fakeDirectory) bind(dn, password string) uint16 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.binds = append(d.binds, dn)
+	if dn == "" && password == "" {
+		return ldap.LDAPResultSuccess
+	}
+	for _, entry := range d.entries {
+		if entry.dn == dn && entry.password != "" && entry.password == password {
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (d *fakeDirectory) search(op *ber.Packet) []*ber.Packet {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	base := op.Children[0].Data.String()
+	filter := op.Children[6]
+	if decompiled, err := ldap.DecompileFilter(filter); err == nil {
+		d.filters = append(d.filters, decompiled)
+	}
+
+	var results []*ber.Packet
+	for _, entry := range d.entries {
+		if !strings.HasSuffix(entry.dn, ","+base) || !entry.matches(filter) {
+			continue
+		}
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "entry")
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "dn"))
+		attributes := ber.NewSequence("attributes")
+		for name, values := range entry.attributes {
+			attribute := ber.NewSequence("attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+			for _, value := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+			}
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+		result.AppendChild(attributes)
+		results = append(results, result)
+	}
+	return results
+}
+
+// matches evaluates the filter against the entry, unknown filter types match nothing
+func (e ldapTestEntry) matches(filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !e.matches(child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if e.matches(child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterEqualityMatch:
+		values := e.attributes[filter.Children[0].Data.String()]
+		return slices.ContainsFunc(values, func(value string) bool {
+			return strings.EqualFold(value, filter.Children[1].Data.String())
+		})
+	case ldap.FilterPresent:
+		return len(e.attributes[filter.Data.String()]) > 0
+	}
+	return false
+}
+
+func (d *fakeDirectory) reply(conn net.Conn, id any, tag ber.Tag, code uint16) {
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	d.write(conn, id, response)
+}
+
+func (d *fakeDirectory) write(conn net.Conn, id any, op *ber.Packet) {
+	message := ber.NewSequence("message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "messageID"))
+	message.AppendChild(op)
+	conn.Write(message.Bytes())
+}
+
+func TestLDAPLogin(t *testing.T) {
+	setupTestDB(t)
+	directory := newFakeDirectory(t)
+
+	user, err := ldapAuthenticator{}.Authenticate("alice", "alice secret")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if user.Username != "alice" || user.Source != db.SourceLDAP {
+		t.Errorf("user = %s from %s, want alice from ldap", user.Username, user.Source)
+	}
+	if !slices.Equal(user.Groups, []string{"dev", "ops"}) {
+		t.Errorf("groups = %v, want [dev ops]", user.Groups)
+	}
+
+	// The user is searched and the groups are read as the service account
+	binds, filters := directory.recorded()
+	want := []string{ldapTestServiceDN, ldapTestUser("alice").dn, ldapTestServiceDN}
+	if !slices.Equal(binds, want) {
+		t.Errorf("binds = %v, want %v", binds, want)
+	}
+	wantFilters := []string{"(uid=alice)", "(|(member=" + ldapTestUser("alice").dn + ")(uniqueMember=" + ldapTestUser("alice").dn + "))"}
+	if !slices.Equal(filters, wantFilters) {
+		t.Errorf("filters = %v, want %v", filters, wantFilters)
+	}
+}
+
+func TestLDAPServiceBind(t *testing.T) {
+	setupTestDB(t)
+	directory := newFakeDirectory(t)
+
+	ldapBindPassword = "wrong"
+	if _, err := (ldapAuthenticator{}).Authenticate("alice", "alice secret"); err == nil || errors.Is(err, errInvalidCredentials) {
+		t.Errorf("wrong service password: err = %v, want a service bind error", err)
+	}
+	if _, filters := directory.recorded(); len(filters) != 0 {
+		t.Errorf("searched %v after a failed service bind", filters)
+	}
+
+	// Without a bind DN the search runs anonymously
+	ldapBindDN, ldapBindPassword = "", ""
+	if _, err := (ldapAuthenticator{}).Authenticate("alice", "alice secret"); err != nil {
+		t.Fatalf("anonymous search: %v", err)
+	}
+	binds, _ := directory.recorded()
+	want := []string{ldapTestServiceDN, "", ldapTestUser("alice").dn, ""}
+	if !slices.Equal(binds, want) {
+		t.Errorf("binds = %q, want %q", binds, want)
+	}
+}
+
+func TestLDAPWrongPassword(t *testing.T) {
+	setupTestDB(t)
+	newFakeDirectory(t)
+
+	for _, username := range []string{"alice", "dave"} {
+		if _, err := (ldapAuthenticator{}).Authenticate(username, "bob secret"); !errors.Is(err, errInvalidCredentials) {
+			t.Errorf("%s: err = %v, want invalid credentials", username, err)
+		}
+	}
+}
+
+func TestLDAPEmptyPassword(t *testing.T) {
+	setupTestDB(t)
+	directory := newFakeDirectory(t)
+
+	// The directory would accept this as an unauthenticated bind
+	if _, err := (ldapAuthenticator{}).Authenticate("alice", ""); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("err = %v, want invalid credentials", err)
+	}
+	if binds, _ := directory.recorded(); len(binds) != 0 {
+		t.Errorf("binds = %v, want none", binds)
+	}
+}
+
+func TestLDAPFilterInjection(t *testing.T) {
+	setupTestDB(t)
+	directory := newFakeDirectory(t)
+
+	tests := []struct {
+		username string
+		filter   string
+	}{
+		{"*", `(uid=\2a)`},
+		{"*)(uid=*", `(uid=\2a\29\28uid=\2a)`},
+		{"alice)(|(uid=*", `(uid=alice\29\28|\28uid=\2a)`},
+		{`alice\`, `(uid=alice\5c)`},
+	}
+	for _, test := range tests {
+		if _, err := (ldapAuthenticator{}).Authenticate(test.username, "alice secret"); !errors.Is(err, errInvalidCredentials) {
+			t.Errorf("%q: err = %v, want invalid credentials", test.username, err)
+		}
+		_, filters := directory.recorded()
+		if len(filters) == 0 || filters[len(filters)-1] != test.filter {
+			t.Errorf("%q: filters = %v, want %s last", test.username, filters, test.filter)
+		}
+	}
+
+	// Only the service account bound, no user was found
+	binds, _ := directory.recorded()
+	for _, bind := range binds {
+		if bind != ldapTestServiceDN {
+			t.Errorf("bound as %s", bind)
+		}
+	}
+}
+
+func TestLDAPGroupRoles(t *testing.T) {
+	setupTestDB(t)
+	directory := newFakeDirectory(t)
+	// Keeps alice from being the last admin when she loses the group
+	createTestUser(t, "root", "admin")
+
+	tests := []struct {
+		username string
+		role     string
+	}{
+		{"alice", "admin"},
+		{"bob", "editor"},
+		{"carol", "viewer"},
+	}
+	for _, test := range tests {
+		user, err := ldapAuthenticator{}.Authenticate(test.username, test.username+" secret")
+		if err != nil {
+			t.Fatalf("%s: %v", test.username, err)
+		}
+		if user.Role != test.role {
+			t.Errorf("%s: role = %s, want %s", test.username, user.Role, test.role)
+		}
+	}
+
+	// Group changes in the directory apply on the next login
+	directory.setGroups("ops")
+	directory.setGroups("dev", "carol")
+	for _, test := range []struct {
+		username string
+		role     string
+		groups   []string
+	}{
+		{"alice", "viewer", nil},
+		{"carol", "editor", []string{"dev"}},
+	} {
+		user, err := ldapAuthenticator{}.Authenticate(test.username, test.username+" secret")
+		if err != nil {
+			t.Fatalf("%s: %v", test.username, err)
+		}
+		if user.Role != test.role || !slices.Equal(user.Groups, test.groups) {
+			t.Errorf("%s: role %s with %v, want %s with %v", test.username, user.Role, user.Groups, test.role, test.groups)
+		}
+	}
+}
+
+func TestLDAPFallbackToLocal(t *testing.T) {
+	setupTestDB(t)
+	newFakeDirectory(t)
+	createTestUser(t, "root", "admin")
+
+	saved := authenticators
+	t.Cleanup(func() { authenticators = saved })
+	authenticators = []Authenticator{ldapAuthenticator{}, localAuthenticator{}}
+
+	if user, ok := validateCredentials("alice", "alice secret"); !ok || user.Source != db.SourceLDAP {
+		t.Errorf("directory user: ok = %v, source = %s", ok, user.Source)
+	}
+	if _, ok := validateCredentials("root", "correct horse 42"); !ok {
+		t.Error("local user rejected while the directory is up")
+	}
+
+	// Nothing listens on the port of a closed listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldapURL = "ldap://" + listener.Addr().String()
+	listener.Close()
+
+	if _, ok := validateCredentials("root", "correct horse 42"); !ok {
+		t.Error("local user rejected while the directory is down")
+	}
+	if _, ok := validateCredentials("root", "wrong password"); ok {
+		t.Error("wrong local password accepted")
+	}
+	// Directory users cannot fall back to a password stored in Latios
+	if _, ok := validateCredentials("alice", "alice secret"); ok {
+		t.Error("directory user logged in while the directory is down")
+	}
+}
@@ -0,0 +1,315 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/timsalokat/latios_proxy/config"
+	"github.com/timsalokat/latios_proxy/db"
+	"golang.org/x/oauth2"
+)
+
+// Login through an external OpenID Connect provider, enabled by setting OIDC_ISSUER
+var (
+	oidcIssuer        = os.Getenv("OIDC_ISSUER")
+	oidcClientID      = os.Getenv("OIDC_CLIENT_ID")
+	oidcClientSecret  = os.Getenv("OIDC_CLIENT_SECRET")
+	oidcRedirectURL   = os.Getenv("OIDC_REDIRECT_URL")
+	oidcName          = config.GetEnv("OIDC_NAME", "single sign-on")
+	oidcScopes        = splitList(config.GetEnv("OIDC_SCOPES", "openid,profile,email"))
+	oidcUsernameClaim = config.GetEnv("OIDC_USERNAME_CLAIM", "preferred_username")
+	oidcGroupsClaim   = config.GetEnv("OIDC_GROUPS_CLAIM", "groups")
+	oidcAdminGroups   = splitList(os.Getenv("OIDC_ADMIN_GROUPS"))
+	oidcEditorGroups  = splitList(os.Getenv("OIDC_EDITOR_GROUPS"))
+)
+
+const oidcCookieName = "latios_oidc"
+
+// Time to log in at the provider before the state cookie expires
+const oidcLoginLifetime = 10 * time.Minute
+
+// The discovered provider, failed discoveries are retried on the next login
+var oidcProviderCache *oidc.Provider
+var oidcProviderLock sync.Mutex
+
+// oidcState ties the callback to the browser that started the login. It is signed and
+// kept in a cookie, so no server side storage is needed.
+type oidcState struct {
+	Purpose  string `json:"purpose"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+	jwt.RegisteredClaims
+}
+
+type OIDCConfigResponse struct {
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name,omitempty"`
+}
+
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func randomString() string {
+	bytes := make([]byte, 24)
+	rand.Read(bytes)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+func oidcEnabled() bool {
+	return oidcIssuer != "" && oidcClientID != ""
+}
+
+func oidcProvider(r *http.Request) (*oidc.Provider, error) {
+	oidcProviderLock.Lock()
+	defer oidcProviderLock.Unlock()
+
+	if oidcProviderCache != nil {
+		return oidcProviderCache, nil
+	}
+	provider, err := oidc.NewProvider(r.Context(), oidcIssuer)
+	if err != nil {
+		return nil, err
+	}
+	oidcProviderCache = provider
+	return provider, nil
+}
+
+// oauthConfig builds the client config, the callback defaults to the host the login started on
+func oauthConfig(r *http.Request, provider *oidc.Provider) *oauth2.Config {
+	redirectURL := oidcRedirectURL
+	if redirectURL == "" {
+		redirectURL = requestScheme(r) + "://" + r.Host + "/latios-api/oidc/callback"
+	}
+	return &oauth2.Config{
+		ClientID:     oidcClientID,
+		ClientSecret: oidcClientSecret,
+		RedirectURL:  redirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       oidcScopes,
+	}
+}
+
+// OIDCConfigApiHandler tells the login page whether to offer the provider
+func OIDCConfigApiHandler(w http.ResponseWriter, r *http.Request) {
+	response := OIDCConfigResponse{Enabled: oidcEnabled()}
+	if response.Enabled {
+		response.Name = oidcName
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// OIDCLoginHandler sends the browser to the provider with a fresh state, nonce and PKCE verifier
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	provider, err := oidcProvider(r)
+	if err != nil {
+		log.Printf("[AUTH] OIDC discovery of %s failed: %v", oidcIssuer, err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := &oidcState{
+		Purpose:  "oidc",
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: oauth2.GenerateVerifier(),
+		Redirect: safeRedirect(r.URL.Query().Get("redirect")),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(oidcLoginLifetime)),
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, state).SignedString(jwtKey)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    signed,
+		Path:     "/latios-api/oidc/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		MaxAge:   int(oidcLoginLifetime.Seconds()),
+		SameSite: http.SameSiteLaxMode, // sent on the top level redirect back from the provider
+	})
+
+	target := oauthConfig(r, provider).AuthCodeURL(state.State, oidc.Nonce(state.Nonce), oauth2.S256ChallengeOption(state.Verifier))
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// OIDCCallbackHandler exchanges the code, validates the ID token and logs the mapped user in
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The state cookie is only good for one attempt
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    "",
+		Path:     "/latios-api/oidc/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		MaxAge:   -1,
+	})
+
+	user, redirect, err := oidcLogin(r)
+	if err != nil {
+		log.Printf("[AUTH] OIDC login failed: %v", err)
+		auditAs(r, user.Username, db.AuditLogin, r.Host, fmt.Errorf("oidc: %w", err))
+		http.Redirect(w, r, "/latios/login?error="+url.QueryEscape("Single sign-on failed"), http.StatusFound)
+		return
+	}
+
+	if err := issueSession(w, r, user); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[AUTH] User %s logged in through OIDC, redirecting to %s", user.Username, redirect)
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// oidcLogin checks the callback against the state cookie and returns the synced user
+func oidcLogin(r *http.Request) (db.User, string, error) {
+	var user db.User
+
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return user, "", errors.New("missing state cookie")
+	}
+	state := &oidcState{}
+	token, err := jwt.ParseWithClaims(cookie.Value, state, func(t *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil || !token.Valid || state.Purpose != "oidc" {
+		return user, "", errors.New("invalid state cookie")
+	}
+
+	query := r.URL.Query()
+	if query.Get("state") != state.State {
+		return user, "", errors.New("state mismatch")
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		return user, "", fmt.Errorf("provider returned %s: %s", providerErr, query.Get("error_description"))
+	}
+
+	provider, err := oidcProvider(r)
+	if err != nil {
+		return user, "", err
+	}
+	config := oauthConfig(r, provider)
+
+	oauthToken, err := config.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		return user, "", fmt.Errorf("code exchange: %w", err)
+	}
+	rawIDToken, ok := oauthToken.Extra("id_token").(string)
+	if !ok {
+		return user, "", errors.New("no id_token in token response")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: oidcClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil {
+		return user, "", fmt.Errorf("id token: %w", err)
+	}
+	if idToken.Nonce != state.Nonce {
+		return user, "", errors.New("nonce mismatch")
+	}
+
+	claims := map[string]any{}
+	if err := idToken.Claims(&claims); err != nil {
+		return user, "", err
+	}
+
+	// Some providers only put profile and group claims into the userinfo response
+	if _, ok := claims[oidcUsernameClaim]; !ok || claims[oidcGroupsClaim] == nil {
+		if info, err := provider.UserInfo(r.Context(), oauth2.StaticTokenSource(oauthToken)); err == nil && info.Subject == idToken.Subject {
+			extra := map[string]any{}
+			if err := info.Claims(&extra); err == nil {
+				for key, value := range extra {
+					if _, ok := claims[key]; !ok {
+						claims[key] = value
+					}
+				}
+			}
+		}
+	}
+
+	username, _ := claims[oidcUsernameClaim].(string)
+	if username == "" {
+		return user, "", fmt.Errorf("claim %s is missing", oidcUsernameClaim)
+	}
+	groups := claimStrings(claims[oidcGroupsClaim])
+
+	user, err = db.SyncExternalUser(db.SourceOIDC, username, groupRole(groups, oidcAdminGroups, oidcEditorGroups), groups)
+	if err != nil {
+		return db.User{Username: username}, "", err
+	}
+	return user, state.Redirect, nil
+}
+
+// claimStrings reads a claim that is a list of strings or a single string
+func claimStrings(value any) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		var result []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// groupRole maps the groups of an external user to a role. Without admin and editor groups
+// roles are managed in Latios and the result is empty.
+func groupRole(groups, adminGroups, editorGroups []string) string {
+	if len(adminGroups) == 0 && len(editorGroups) == 0 {
+		return ""
+	}
+	for _, group := range groups {
+		if slices.Contains(adminGroups, group) {
+			return db.RoleAdmin
+		}
+	}
+	for _, group := range groups {
+		if slices.Contains(editorGroups, group) {
+			return db.RoleEditor
+		}
+	}
+	return db.RoleViewer
+}
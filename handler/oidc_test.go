@@ -0,0 +1,417 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+// mockIdentityProvider serves discovery, JWKS, authorize, token and userinfo endpoints.
+// Authorize answers at once with a code, the token endpoint checks the PKCE verifier.
+type mockIdentityProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	lock     sync.Mutex
+	requests map[string]url.Values // authorize requests by code
+	claims   map[string]any        // added to or replacing claims of the ID token
+	userinfo map[string]any
+}
+
+func newMockIdentityProvider(t *testing.T) *mockIdentityProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &mockIdentityProvider{key: key, requests: map[string]url.Values{}, claims: map[string]any{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", provider.discovery)
+	mux.HandleFunc("/jwks", provider.jwks)
+	mux.HandleFunc("/authorize", provider.authorize)
+	mux.HandleFunc("/token", provider.token)
+	mux.HandleFunc("/userinfo", provider.userinfoEndpoint)
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+
+	// Point the login at the mock provider
+	issuer, clientID, clientSecret, redirectURL := oidcIssuer, oidcClientID, oidcClientSecret, oidcRedirectURL
+	adminGroups, editorGroups := oidcAdminGroups, oidcEditorGroups
+	t.Cleanup(func() {
+		oidcIssuer, oidcClientID, oidcClientSecret, oidcRedirectURL = issuer, clientID, clientSecret, redirectURL
+		oidcAdminGroups, oidcEditorGroups = adminGroups, editorGroups
+		oidcProviderCache = nil
+	})
+	oidcIssuer, oidcClientID, oidcClientSecret, oidcRedirectURL = provider.server.URL, "latios", "client secret", ""
+	oidcAdminGroups, oidcEditorGroups = nil, nil
+	oidcProviderCache = nil
+	return provider
+}
+
+func (p *mockIdentityProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := p.server.URL
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/jwks",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *mockIdentityProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &p.key.PublicKey, KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+	}})
+}
+
+func (p *mockIdentityProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	code := randomString()
+	p.lock.Lock()
+	p.requests[code] = query
+	p.lock.Unlock()
+
+	target, _ := url.Parse(query.Get("redirect_uri"))
+	target.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (p *mockIdentityProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	p.lock.Lock()
+	request, ok := p.requests[r.Form.Get("code")]
+	delete(p.requests, r.Form.Get("code"))
+	claims := map[string]any{}
+	for name, value := range p.claims {
+		claims[name] = value
+	}
+	p.lock.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || request.Get("code_challenge_method") != "S256" ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != request.Get("code_challenge") ||
+		r.Form.Get("redirect_uri") != request.Get("redirect_uri") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	now := time.Now()
+	idToken := map[string]any{
+		"iss":   p.server.URL,
+		"aud":   request.Get("client_id"),
+		"sub":   "subject-1",
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Minute).Unix(),
+		"nonce": request.Get("nonce"),
+	}
+	for name, value := range claims {
+		idToken[name] = value
+	}
+
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: p.key, KeyID: "test"}}, nil)
+	payload, _ := json.Marshal(idToken)
+	signed, _ := signer.Sign(payload)
+	raw, _ := signed.CompactSerialize()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "token_type": "Bearer", "expires_in": 60, "id_token": raw})
+}
+
+func (p *mockIdentityProvider) userinfoEndpoint(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.userinfo == nil || r.Header.Get("Authorization") != "Bearer access" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(p.userinfo)
+}
+
+func (p *mockIdentityProvider) set(claims map[string]any) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.claims = claims
+}
+
+// oidcAttempt is a login started with OIDCLoginHandler and answered by the provider
+type oidcAttempt struct {
+	cookie    *http.Cookie
+	authorize url.Values
+	callback  *url.URL
+}
+
+func startOIDCLogin(t *testing.T) oidcAttempt {
+	t.Helper()
+	w := httptest.NewRecorder()
+	OIDCLoginHandler(w, httptest.NewRequest(http.MethodGet, "http://login.example.com/latios-api/oidc/login?redirect=/dashboard", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcCookieName {
+		t.Fatalf("state cookie = %v", cookies)
+	}
+
+	authorize, _ := url.Parse(w.Header().Get("Location"))
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authorize.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	return oidcAttempt{cookie: cookies[0], authorize: authorize.Query(), callback: callback}
+}
+
+func finishOIDCLogin(attempt oidcAttempt) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, attempt.callback.String(), nil)
+	if attempt.cookie != nil {
+		req.AddCookie(attempt.cookie)
+	}
+	w := httptest.NewRecorder()
+	OIDCCallbackHandler(w, req)
+	return w
+}
+
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == authCookieName && cookie.Value != "" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// expectFailedLogin checks that the callback sent the browser back to the login page without a session
+func expectFailedLogin(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+	if location := w.Header().Get("Location"); !strings.HasPrefix(location, "/latios/login?error=") {
+		t.Errorf("redirect = %q, want the login page with an error", location)
+	}
+	if cookie := sessionCookie(w); cookie != nil {
+		t.Errorf("failed login set a session cookie")
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	setupTestDB(t)
+	provider := newMockIdentityProvider(t)
+	provider.set(map[string]any{"preferred_username": "alice", "groups": []string{"dev", "ops"}})
+
+	attempt := startOIDCLogin(t)
+	if attempt.authorize.Get("code_challenge_method") != "S256" || attempt.authorize.Get("code_challenge") == "" {
+		t.Errorf("authorize request without PKCE: %v", attempt.authorize)
+	}
+	if attempt.authorize.Get("nonce") == "" {
+		t.Errorf("authorize request without nonce")
+	}
+
+	w := finishOIDCLogin(attempt)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/dashboard" {
+		t.Fatalf("callback: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	cookie := sessionCookie(w)
+	if cookie == nil {
+		t.Fatal("no session cookie")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	if claims, ok := authenticate(req); !ok || claims.Username != "alice" {
+		t.Errorf("session does not authenticate alice: %+v", claims)
+	}
+
+	var user db.User
+	if err := db.Client.Where("username = ?", "alice").First(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Source != db.SourceOIDC || user.Role != db.RoleViewer || strings.Join(user.Groups, ",") != "dev,ops" {
+		t.Errorf("user = %+v, want an oidc viewer in dev and ops", user)
+	}
+
+	// The provider cannot log in with the password, external users have none
+	if _, ok := validateCredentials("alice", ""); ok {
+		t.Error("oidc user logged in with an empty password")
+	}
+
+	// Each state cookie works once, the callback removes it
+	if cleared := w.Result().Cookies(); len(cleared) == 0 || cleared[0].Name != oidcCookieName || cleared[0].MaxAge >= 0 {
+		t.Errorf("state cookie was not removed: %v", cleared)
+	}
+}
+
+func TestOIDCGroupsFromUserinfo(t *testing.T) {
+	setupTestDB(t)
+	provider := newMockIdentityProvider(t)
+	provider.set(map[string]any{"preferred_username": "alice"})
+	provider.userinfo = map[string]any{"sub": "subject-1", "groups": []string{"dev", "not a group"}}
+
+	if w := finishOIDCLogin(startOIDCLogin(t)); sessionCookie(w) == nil {
+		t.Fatalf("login failed: %q", w.Header().Get("Location"))
+	}
+
+	var user db.User
+	db.Client.Where("username = ?", "alice").First(&user)
+	if strings.Join(user.Groups, ",") != "dev" {
+		t.Errorf("groups = %v, want only the valid group from userinfo", user.Groups)
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	setupTestDB(t)
+	provider := newMockIdentityProvider(t)
+	provider.set(map[string]any{"preferred_username": "alice"})
+
+	attempt := startOIDCLogin(t)
+	query := attempt.callback.Query()
+	query.Set("state", "forged")
+	attempt.callback.RawQuery = query.Encode()
+	expectFailedLogin(t, finishOIDCLogin(attempt))
+
+	// A callback without the cookie of the browser that started the login
+	attempt = startOIDCLogin(t)
+	attempt.cookie = nil
+	expectFailedLogin(t, finishOIDCLogin(attempt))
+
+	// A state cookie of another login
+	first, second := startOIDCLogin(t), startOIDCLogin(t)
+	first.cookie = second.cookie
+	expectFailedLogin(t, finishOIDCLogin(first))
+
+	// A tampered state cookie
+	attempt = startOIDCLogin(t)
+	attempt.cookie.Value += "x"
+	expectFailedLogin(t, finishOIDCLogin(attempt))
+
+	if err := db.Client.Where("username = ?", "alice").First(&db.User{}).Error; err == nil {
+		t.Error("user was created by a failed login")
+	}
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	setupTestDB(t)
+	provider := newMockIdentityProvider(t)
+	provider.set(map[string]any{"preferred_username": "alice", "nonce": "replayed"})
+	expectFailedLogin(t, finishOIDCLogin(startOIDCLogin(t)))
+
+	provider.set(map[string]any{"preferred_username": "alice", "aud": "another-client"})
+	expectFailedLogin(t, finishOIDCLogin(startOIDCLogin(t)))
+
+	provider.set(map[string]any{"preferred_username": "alice", "exp": time.Now().Add(-time.Minute).Unix()})
+	expectFailedLogin(t, finishOIDCLogin(startOIDCLogin(t)))
+}
+
+func TestOIDCPKCEVerifier(t *testing.T) {
+	setupTestDB(t)
+	provider := newMockIdentityProvider(t)
+	provider.set(map[string]any{"preferred_username": "alice"})
+
+	// A code of one login injected into the callback of another fails the PKCE check, even
+	// with the state of the victim
+	victim, attacker := startOIDCLogin(t), startOIDCLogin(t)
+	query := victim.callback.Query()
+	query.Set("code", attacker.callback.Query().Get("code"))
+	victim.callback.RawQuery = query.Encode()
+	expectFailedLogin(t, finishOIDCLogin(victim))
+}
+
+func TestOIDCSourceMismatch(t *testing.T) {
+	setupTestDB(t)
+	local := createTestUser(t, "bob", db.RoleAdmin)
+	provider := newMockIdentityProvider(t)
+	provider.set(map[string]any{"preferred_username": "bob", "groups": []string{"dev"}})
+
+	expectFailedLogin(t, finishOIDCLogin(startOIDCLogin(t)))
+
+	var user db.User
+	db.Client.First(&user, local.ID)
+	if user.Source != db.SourceLocal || user.Role != db.RoleAdmin || len(user.Groups) != 0 {
+		t.Errorf("local user was changed by the provider: %+v", user)
+	}
+	if _, err := db.SyncExternalUser(db.SourceOIDC, "bob", "", nil); !errors.Is(err, db.ErrSourceMismatch) {
+		t.Errorf("SyncExternalUser = %v, want ErrSourceMismatch", err)
+	}
+}
+
+func TestOIDCRoleMapping(t *testing.T) {
+	setupTestDB(t)
+	root := createTestUser(t, "root", db.RoleAdmin)
+	provider := newMockIdentityProvider(t)
+	oidcAdminGroups = []string{"admins"}
+	oidcEditorGroups = []string{"editors", "ops"}
+
+	steps := []struct {
+		groups []string
+		role   string
+	}{
+		{[]string{"ops"}, db.RoleEditor},
+		{[]string{"dev", "admins"}, db.RoleAdmin},
+		{[]string{"editors", "admins"}, db.RoleAdmin},
+		{[]string{"dev"}, db.RoleViewer},
+		{nil, db.RoleViewer},
+	}
+	for _, step := range steps {
+		provider.set(map[string]any{"preferred_username": "alice", "groups": step.groups})
+		if w := finishOIDCLogin(startOIDCLogin(t)); sessionCookie(w) == nil {
+			t.Fatalf("login with %v failed: %q", step.groups, w.Header().Get("Location"))
+		}
+
+		var user db.User
+		db.Client.Where("username = ?", "alice").First(&user)
+		if user.Role != step.role {
+			t.Errorf("groups %v: role = %s, want %s", step.groups, user.Role, step.role)
+		}
+	}
+
+	// The last administrator keeps the role when the groups change
+	provider.set(map[string]any{"preferred_username": "alice", "groups": []string{"admins"}})
+	finishOIDCLogin(startOIDCLogin(t))
+	if _, err := db.DeleteUser(root.ID); err != nil {
+		t.Fatal(err)
+	}
+	provider.set(map[string]any{"preferred_username": "alice", "groups": []string{"dev"}})
+	finishOIDCLogin(startOIDCLogin(t))
+
+	var user db.User
+	db.Client.Where("username = ?", "alice").First(&user)
+	if user.Role != db.RoleAdmin {
+		t.Errorf("last admin was demoted to %s", user.Role)
+	}
+}
+
+func TestGroupRole(t *testing.T) {
+	tests := []struct {
+		groups, admin, editor []string
+		want                  string
+	}{
+		{[]string{"ops"}, nil, nil, ""},
+		{[]string{"ops"}, []string{"ops"}, nil, db.RoleAdmin},
+		{[]string{"dev", "ops"}, []string{"ops"}, []string{"dev"}, db.RoleAdmin},
+		{[]string{"dev"}, []string{"ops"}, []string{"dev"}, db.RoleEditor},
+		{[]string{"qa"}, []string{"ops"}, []string{"dev"}, db.RoleViewer},
+		{nil, nil, []string{"dev"}, db.RoleViewer},
+		{[]string{"OPS"}, []string{"ops"}, nil, db.RoleViewer},
+	}
+	for _, test := range tests {
+		if got := groupRole(test.groups, test.admin, test.editor); got != test.want {
+			t.Errorf("groupRole(%v, %v, %v) = %q, want %q", test.groups, test.admin, test.editor, got, test.want)
+		}
+	}
+}
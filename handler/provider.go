@@ -0,0 +1,596 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/timsalokat/latios_proxy/config"
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+// Latios as OpenID provider for applications behind its routes. The issuer defaults to
+// https://<LOGIN_HOST>/latios-api/provider, where the session cookie is available.
+var providerIssuerOverride = os.Getenv("OIDC_PROVIDER_ISSUER")
+
+const providerPath = "/latios-api/provider"
+
+// Authorization codes are redeemed right away by the application
+const providerCodeLifetime = time.Minute
+const providerTokenLifetime = time.Hour
+
+// Signing keys newest first, loaded from the database at startup. Keys of other instances
+// are added when a token signed with them is verified.
+var providerKeys []providerKey
+var providerKeysLock sync.Mutex
+
+type providerKey struct {
+	id  string
+	key *rsa.PrivateKey
+}
+
+// providerCode is the authorization code. It is signed with the session key and only
+// readable by Latios, only the IDs of redeemed codes are stored.
+type providerCode struct {
+	Purpose       string `json:"purpose"`
+	ClientID      string `json:"client_id"`
+	RedirectURI   string `json:"redirect_uri"`
+	Scope         string `json:"scope"`
+	Nonce         string `json:"nonce,omitempty"`
+	CodeChallenge string `json:"code_challenge,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type providerIDToken struct {
+	Nonce             string   `json:"nonce,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Name              string   `json:"name,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// providerAccessToken is only accepted by the userinfo endpoint
+type providerAccessToken struct {
+	Purpose  string `json:"purpose"`
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+	jwt.RegisteredClaims
+}
+
+type ProviderTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// ProviderUserInfo holds the claims released by the granted scopes, the profile scope adds the
+// names and the groups scope the groups
+type ProviderUserInfo struct {
+	Subject           string   `json:"sub"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Name              string   `json:"name,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+}
+
+type CreateOIDCClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// CreateOIDCClientResponse carries the client secret, it cannot be shown again later
+type CreateOIDCClientResponse struct {
+	db.OIDCClient
+	ClientSecret string `json:"client_secret"`
+}
+
+func providerIssuer() string {
+	if providerIssuerOverride != "" {
+		return strings.TrimSuffix(providerIssuerOverride, "/")
+	}
+	return "https://" + config.LOGIN_HOST + providerPath
+}
+
+// loadProviderKeys reads the signing keys and creates the first one if there is none yet
+func loadProviderKeys() error {
+	stored, err := db.OIDCKeys()
+	if err != nil {
+		return err
+	}
+
+	if len(stored) == 0 {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		if err := db.AddOIDCKey(randomString(), string(encoded)); err != nil {
+			return err
+		}
+		log.Printf("[AUTH] Created OIDC provider signing key")
+		if stored, err = db.OIDCKeys(); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]providerKey, 0, len(stored))
+	for _, item := range stored {
+		block, _ := pem.Decode([]byte(item.PrivateKey))
+		if block == nil {
+			log.Printf("[AUTH] Skipping broken OIDC signing key %s", item.ID)
+			continue
+		}
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			log.Printf("[AUTH] Skipping broken OIDC signing key %s: %v", item.ID, err)
+			continue
+		}
+		keys = append(keys, providerKey{id: item.ID, key: key})
+	}
+	if len(keys) == 0 {
+		return errors.New("no usable signing key")
+	}
+
+	providerKeys = keys
+	return nil
+}
+
+// InitProvider loads the signing keys and creates the first one on a new database. Without
+// keys they are loaded again on first use.
+func InitProvider() {
+	providerKeysLock.Lock()
+	defer providerKeysLock.Unlock()
+
+	if err := loadProviderKeys(); err != nil {
+		log.Printf("[AUTH] Couldnt load OIDC signing keys: %v", err)
+	}
+}
+
+// signingKey returns the newest key
+func signingKey() (providerKey, error) {
+	providerKeysLock.Lock()
+	defer providerKeysLock.Unlock()
+
+	if len(providerKeys) == 0 {
+		if err := loadProviderKeys(); err != nil {
+			return providerKey{}, err
+		}
+	}
+	return providerKeys[0], nil
+}
+
+// verificationKey finds a key by ID, keys created by other instances are loaded on demand
+func verificationKey(id string) (*rsa.PublicKey, error) {
+	providerKeysLock.Lock()
+	defer providerKeysLock.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		for _, key := range providerKeys {
+			if key.id == id {
+				return &key.key.PublicKey, nil
+			}
+		}
+		if attempt == 0 {
+			if err := loadProviderKeys(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, errors.New("unknown signing key")
+}
+
+func signProviderToken(claims jwt.Claims) (string, error) {
+	key, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.key)
+}
+
+// ProviderDiscoveryHandler serves the OpenID provider metadata
+func ProviderDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	issuer := providerIssuer()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "groups"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "preferred_username", "name", "groups"},
+	})
+}
+
+// ProviderJWKSHandler publishes the public signing keys
+func ProviderJWKSHandler(w http.ResponseWriter, r *http.Request) {
+	providerKeysLock.Lock()
+	var err error
+	if len(providerKeys) == 0 {
+		err = loadProviderKeys()
+	}
+	keys := providerKeys
+	providerKeysLock.Unlock()
+	if err != nil {
+		log.Printf("[AUTH] Couldnt load OIDC signing keys: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	encoded := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		encoded = append(encoded, map[string]string{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": key.id,
+			"n":   base64.RawURLEncoding.EncodeToString(key.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.key.E)).Bytes()),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"keys": encoded})
+}
+
+// ProviderAuthorizeHandler hands an authorization code for the logged in user to the application.
+// Visitors without session are sent to the login page first.
+func ProviderAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	client, err := db.OIDCClientByClientID(query.Get("client_id"))
+	if err != nil {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI := query.Get("redirect_uri")
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		http.Error(w, "redirect_uri is not registered for this client", http.StatusBadRequest)
+		return
+	}
+
+	// From here on errors go back to the application
+	fail := func(code, description string) {
+		target, _ := url.Parse(redirectURI)
+		values := target.Query()
+		values.Set("error", code)
+		values.Set("error_description", description)
+		if state := query.Get("state"); state != "" {
+			values.Set("state", state)
+		}
+		target.RawQuery = values.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	}
+
+	if query.Get("response_type") != "code" {
+		fail("unsupported_response_type", "only the code flow is supported")
+		return
+	}
+	if !slices.Contains(strings.Fields(query.Get("scope")), "openid") {
+		fail("invalid_scope", "the openid scope is required")
+		return
+	}
+	challenge := query.Get("code_challenge")
+	if challenge != "" && query.Get("code_challenge_method") != "S256" {
+		fail("invalid_request", "only the S256 code challenge method is supported")
+		return
+	}
+
+	claims, ok := authenticate(r)
+	if !ok || claims.TokenID != 0 {
+		gotoLogin(w, r)
+		return
+	}
+	r = withUser(r, claims)
+
+	var user db.User
+	if err := db.Client.Where("username = ?", claims.Username).First(&user).Error; err != nil {
+		fail("access_denied", "unknown user")
+		return
+	}
+
+	now := time.Now()
+	code := &providerCode{
+		Purpose:       "code",
+		ClientID:      client.ClientID,
+		RedirectURI:   redirectURI,
+		Scope:         query.Get("scope"),
+		Nonce:         query.Get("nonce"),
+		CodeChallenge: challenge,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        randomString(),
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(providerCodeLifetime)),
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, code).SignedString(jwtKey)
+	if err != nil {
+		fail("server_error", "could not create the authorization code")
+		return
+	}
+
+	audit(r, db.AuditOIDCAuthorize, client.Name, nil)
+	log.Printf("[AUTH] User %s authorized OIDC client %s", user.Username, client.Name)
+
+	target, _ := url.Parse(redirectURI)
+	values := target.Query()
+	values.Set("code", signed)
+	if state := query.Get("state"); state != "" {
+		values.Set("state", state)
+	}
+	target.RawQuery = values.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// ProviderTokenHandler exchanges an authorization code for an ID token and an access token
+func ProviderTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "invalid form body")
+		return
+	}
+
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		// Basic credentials are form encoded, see RFC 6749 section 2.3.1
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client, err := db.AuthenticateOIDCClient(clientID, secret)
+	if err != nil {
+		log.Printf("[AUTH] OIDC token request with invalid credentials for client %q", clientID)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	code, err := parseProviderCode(r.PostForm.Get("code"), client, r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	if err != nil {
+		log.Printf("[AUTH] OIDC token request of client %s rejected: %v", client.Name, err)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	var user db.User
+	if err := db.Client.First(&user, subjectID(code.Subject)).Error; err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "the user no longer exists")
+		return
+	}
+
+	now := time.Now()
+	expires := jwt.NewNumericDate(now.Add(providerTokenLifetime))
+	info := providerUserInfo(user, code.Subject, code.Scope)
+	idToken, err := signProviderToken(&providerIDToken{
+		Nonce:             code.Nonce,
+		PreferredUsername: info.PreferredUsername,
+		Name:              info.Name,
+		Groups:            info.Groups,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    providerIssuer(),
+			Subject:   code.Subject,
+			Audience:  jwt.ClaimStrings{client.ClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: expires,
+		},
+	})
+	if err != nil {
+		log.Printf("[AUTH] Couldnt sign OIDC ID token: %v", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "could not sign the token")
+		return
+	}
+
+	accessToken, err := signProviderToken(&providerAccessToken{
+		Purpose:  "access",
+		ClientID: client.ClientID,
+		Scope:    code.Scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    providerIssuer(),
+			Subject:   code.Subject,
+			Audience:  jwt.ClaimStrings{providerIssuer() + "/userinfo"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: expires,
+		},
+	})
+	if err != nil {
+		log.Printf("[AUTH] Couldnt sign OIDC access token: %v", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "could not sign the token")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(ProviderTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(providerTokenLifetime.Seconds()),
+		IDToken:     idToken,
+		Scope:       code.Scope,
+	})
+}
+
+// parseProviderCode checks an authorization code against the client, redirect URI and PKCE verifier
+func parseProviderCode(signed string, client db.OIDCClient, redirectURI, verifier string) (*providerCode, error) {
+	code := &providerCode{}
+	token, err := jwt.ParseWithClaims(signed, code, func(t *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil || !token.Valid || code.Purpose != "code" {
+		return nil, errors.New("invalid or expired code")
+	}
+	if code.ClientID != client.ClientID || code.RedirectURI != redirectURI {
+		return nil, errors.New("code was issued for another client or redirect_uri")
+	}
+	if code.CodeChallenge != "" {
+		sum := sha256.Sum256([]byte(verifier))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != code.CodeChallenge {
+			return nil, errors.New("code_verifier does not match")
+		}
+	}
+	if err := db.RedeemOIDCCode(code.ID, code.ExpiresAt.Time); err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// ProviderUserInfoHandler returns the claims of the user an access token was issued for
+func ProviderUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	claims := &providerAccessToken{}
+	token, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		id, _ := t.Header["kid"].(string)
+		return verificationKey(id)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Name}),
+		jwt.WithIssuer(providerIssuer()),
+		jwt.WithAudience(providerIssuer()+"/userinfo"),
+	)
+	if err != nil || !token.Valid || claims.Purpose != "access" {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var user db.User
+	if err := db.Client.First(&user, subjectID(claims.Subject)).Error; err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providerUserInfo(user, claims.Subject, claims.Scope))
+}
+
+// providerUserInfo returns the claims of the user the scope grants access to
+func providerUserInfo(user db.User, subject, scope string) ProviderUserInfo {
+	scopes := strings.Fields(scope)
+	info := ProviderUserInfo{Subject: subject}
+	if slices.Contains(scopes, "profile") {
+		info.PreferredUsername = user.Username
+		info.Name = user.Username
+	}
+	if slices.Contains(scopes, "groups") {
+		info.Groups = user.Groups
+	}
+	return info
+}
+
+// subjectID returns the user ID of a subject claim, 0 matches no user
+func subjectID(subject string) uint {
+	id, _ := strconv.ParseUint(subject, 10, 64)
+	return uint(id)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="latios"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// OIDCClientsApiHandler lists and registers applications for the OpenID provider
+func OIDCClientsApiHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+
+	case http.MethodGet:
+		clients, err := db.OIDCClients()
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clients)
+
+	case http.MethodPost:
+		var req CreateOIDCClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeApiError(w, errBadRequest{err})
+			return
+		}
+
+		client, secret, err := db.CreateOIDCClient(req.Name, req.RedirectURIs)
+		audit(r, db.AuditOIDCClientCreate, req.Name, err)
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+
+		log.Printf("[AUTH] OIDC client %s registered by %s", client.Name, actorName(r))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(CreateOIDCClientResponse{OIDCClient: client, ClientSecret: secret})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// OIDCClientApiHandler removes an application
+func OIDCClientApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "id", Message: "invalid client id"})
+		return
+	}
+
+	client, err := db.DeleteOIDCClient(uint(id))
+	audit(r, db.AuditOIDCClientDelete, fmt.Sprintf("oidc client %d", id), err)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	log.Printf("[AUTH] OIDC client %s removed by %s", client.Name, actorName(r))
+	w.WriteHeader(http.StatusNoContent)
+}
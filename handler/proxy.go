@@ -4,12 +4,14 @@ import (
 	_ "embed"
 	"html/template"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/timsalokat/latios_proxy/db"
+	"github.com/timsalokat/latios_proxy/middleware"
 )
 
 //go:embed templates/404.html
@@ -29,17 +31,20 @@ func serveNotFound(w http.ResponseWriter, r *http.Request) {
 var logPrefix = "[PROXY] - "
 
 func ProxyHandler(w http.ResponseWriter, r *http.Request) {
-	host := r.Host
-	var route db.Route
-
 	log.Println(logPrefix + "ProxyHandler called for " + r.Host)
 
-	// Find route
-	result := db.Client.Where("domain = ?", host).First(&route)
-	if result.Error != nil {
+	// Find route with the longest matching path prefix
+	route, ok := lookupRoute(r)
+	if !ok {
 		serveNotFound(w, r)
 		return
 	}
+	// The director of the upstream proxy reads the route from the context
+	r = withRoute(r, route, true)
+
+	if route.StripPrefix && route.PathPrefix != "" {
+		r = stripPathPrefix(r, route.PathPrefix)
+	}
 
 	// Serve static file
 	if route.IsStatic {
@@ -48,35 +53,46 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	target, err := url.Parse(route.TargetPath)
+	b, err := getBalancer(route)
 	if err != nil {
+		log.Printf("%s%v", logPrefix, err)
 		http.Error(w, "bad target", http.StatusInternalServerError)
 		return
 	}
 
+	target := b.next(r)
+	if target == nil {
+		log.Printf("%sno healthy upstream for %s%s", logPrefix, route.Domain, route.PathPrefix)
+		http.Error(w, "no healthy upstream", http.StatusServiceUnavailable)
+		return
+	}
+
+	// log.Println(logPrefix + "Request proxied")
+	target.serve(w, r)
+}
+
+func newUpstreamProxy(target *url.URL) *httputil.ReverseProxy {
 	proxy := httputil.NewSingleHostReverseProxy(target)
 
 	// Header setup
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		originalDirector(req)
-		req.Host = r.Host
-
-		req.Header.Set("Origin", r.Header.Get("Origin"))
 
-		clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
-		req.Header.Set("X-Forwarded-For", clientIP)
-		req.Header.Set("X-Forwarded-Host", r.Host)
+		req.Header.Set("X-Forwarded-For", middleware.ClientIP(req))
+		req.Header.Set("X-Forwarded-Host", req.Host)
 
-		if r.TLS != nil {
+		if req.TLS != nil {
 			req.Header.Set("X-Forwarded-Proto", "https")
 		} else {
 			req.Header.Set("X-Forwarded-Proto", "http")
 		}
 
+		stripCredentials(req)
+		setIdentityHeaders(req)
+
 		// Should be redundant as httputil does it. Aber doppelt hält besser
-		if r.Header.Get("Upgrade") != "" {
-			req.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+		if req.Header.Get("Upgrade") != "" {
 			req.Header.Set("Connection", "upgrade")
 		}
 	}
@@ -100,6 +116,70 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "proxy error", http.StatusBadGateway)
 	}
 
-	// log.Println(logPrefix + "Request proxied")
-	proxy.ServeHTTP(w, r)
+	return proxy
+}
+
+// stripCredentials removes the Latios cookies and bearer tokens, upstreams must not be able
+// to act as the user. Cookies and Authorization headers of the upstream itself are kept.
+func stripCredentials(req *http.Request) {
+	if header := req.Header.Get("Authorization"); header != "" && latiosBearer(header) {
+		req.Header.Del("Authorization")
+	}
+
+	values := req.Header.Values("Cookie")
+	if len(values) == 0 {
+		return
+	}
+	var kept []string
+	for _, value := range values {
+		for _, cookie := range strings.Split(value, ";") {
+			cookie = strings.TrimSpace(cookie)
+			name, _, _ := strings.Cut(cookie, "=")
+			if cookie != "" && name != authCookieName && name != oidcCookieName {
+				kept = append(kept, cookie)
+			}
+		}
+	}
+	req.Header.Del("Cookie")
+	if len(kept) > 0 {
+		req.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// latiosBearer reports whether the Authorization header carries an API token or a session JWT.
+// Expired sessions count too, the signature is enough to tell them apart from upstream tokens.
+func latiosBearer(header string) bool {
+	raw, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(raw, db.ApiTokenPrefix) {
+		return true
+	}
+	_, err := jwt.Parse(raw, func(t *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithoutClaimsValidation())
+	return err == nil
+}
+
+// stripPathPrefix returns a copy of the request with the route prefix removed from its path
+func stripPathPrefix(r *http.Request, prefix string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+
+	r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+	if r2.URL.Path == "" {
+		r2.URL.Path = "/"
+	}
+	if strings.HasPrefix(r.URL.RawPath, prefix) {
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+		if r2.URL.RawPath == "" {
+			r2.URL.RawPath = "/"
+		}
+	} else {
+		r2.URL.RawPath = ""
+	}
+	return r2
 }
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+func TestProxyStripsCredentials(t *testing.T) {
+	jwtKey = []byte("test secret")
+
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	proxy := newUpstreamProxy(target)
+
+	session, err := generateToken(db.User{Username: "alice", Role: db.RoleAdmin},
+		db.Session{ID: "session", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        string
+		wantAuth      string
+		wantCookie    string
+	}{
+		{"session cookie", "", authCookieName + "=" + session, "", ""},
+		{"session cookie between others", "", "a=1; " + authCookieName + "=" + session + "; b=2", "", "a=1; b=2"},
+		{"session bearer", "Bearer " + session, "", "", ""},
+		{"api token", "Bearer " + db.ApiTokenPrefix + "secret", "", "", ""},
+		{"upstream bearer", "Bearer upstream-token", "", "Bearer upstream-token", ""},
+		{"basic auth", "Basic YWxpY2U6c2VjcmV0", "", "Basic YWxpY2U6c2VjcmV0", ""},
+		{"upstream cookies", "", "app_session=xyz", "", "app_session=xyz"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			if test.cookie != "" {
+				req.Header.Set("Cookie", test.cookie)
+			}
+			// Routes with enforce_auth carry the user, the credentials have to go either way
+			req = withUser(req, &Claims{Username: "alice", Role: db.RoleAdmin})
+
+			proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got := received.Get("Authorization"); got != test.wantAuth {
+				t.Errorf("Authorization = %q, want %q", got, test.wantAuth)
+			}
+			if got := received.Get("Cookie"); got != test.wantCookie {
+				t.Errorf("Cookie = %q, want %q", got, test.wantCookie)
+			}
+			if got := received.Get(identityUserHeader); got != "alice" {
+				t.Errorf("%s = %q, want alice", identityUserHeader, got)
+			}
+		})
+	}
+}
+
+func TestStripPathPrefix(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		prefix      string
+		wantPath    string
+		wantRawPath string
+	}{
+		{"sub path", "/api/users", "/api", "/users", ""},
+		{"prefix only", "/api", "/api", "/", ""},
+		{"trailing slash", "/api/", "/api", "/", ""},
+		{"query kept", "/api/users?page=2", "/api", "/users", ""},
+		{"escaped path", "/api/a%2Fb", "/api", "/a/b", "/a%2Fb"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://app.example.com"+test.target, nil)
+			original := req.URL.Path
+			stripped := stripPathPrefix(req, test.prefix)
+
+			if stripped.URL.Path != test.wantPath {
+				t.Errorf("path %q, want %q", stripped.URL.Path, test.wantPath)
+			}
+			if stripped.URL.RawPath != test.wantRawPath {
+				t.Errorf("raw path %q, want %q", stripped.URL.RawPath, test.wantRawPath)
+			}
+			if stripped.URL.RawQuery != req.URL.RawQuery {
+				t.Errorf("query %q, want %q", stripped.URL.RawQuery, req.URL.RawQuery)
+			}
+			if req.URL.Path != original {
+				t.Errorf("original request path changed to %q", req.URL.Path)
+			}
+		})
+	}
+}
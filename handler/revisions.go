@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+// RouteRevisionsApiHandler lists route revisions, newest first, filtered with ?domain= and paged with ?page=
+func RouteRevisionsApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 100
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page <= 0 {
+		page = 1
+	}
+
+	revisions, err := db.RouteRevisions(r.URL.Query().Get("domain"), limit, (page-1)*limit)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// RestoreRevisionApiHandler reapplies the route state of a revision
+func RestoreRevisionApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "id", Message: "invalid revision id"})
+		return
+	}
+
+	route, err := db.RestoreRevision(uint(id), actorName(r))
+	audit(r, db.AuditRouteRestore, fmt.Sprintf("revision %d", id), err)
+	if err != nil {
+		log.Printf("[API] Error restoring revision %d: %v", id, err)
+		writeApiError(w, err)
+		return
+	}
+
+	log.Printf("[API] Restored revision %d of %s%s", id, route.Domain, route.PathPrefix)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(route)
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+// MySessionsApiHandler lists the active sessions of the logged in user
+func MySessionsApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeSessions(w, r, currentUser(r).Username)
+}
+
+// MySessionApiHandler ends one session of the logged in user
+func MySessionApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	revokeSession(w, r, currentUser(r).Username)
+}
+
+// SessionsApiHandler lists the active sessions of all users or of ?username
+func SessionsApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeSessions(w, r, r.URL.Query().Get("username"))
+}
+
+// SessionApiHandler ends any session
+func SessionApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	revokeSession(w, r, "")
+}
+
+func writeSessions(w http.ResponseWriter, r *http.Request, username string) {
+	sessions, err := db.Sessions(username)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	current := currentUser(r).ID
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func revokeSession(w http.ResponseWriter, r *http.Request, username string) {
+	id := r.PathValue("id")
+
+	// Only log the start of the ID, it is enough to tell sessions apart
+	target := id
+	if len(target) > 8 {
+		target = target[:8]
+	}
+
+	err := db.RevokeSession(id, username)
+	audit(r, db.AuditSessionEnd, target, err)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	log.Printf("[AUTH] Session %s revoked by %s", target, actorName(r))
+	w.WriteHeader(http.StatusNoContent)
+}
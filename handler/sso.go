@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/timsalokat/latios_proxy/config"
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+// hostname returns the lower case host of a request without the port
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// withinCookieDomain reports whether the session cookie is sent to host
+func withinCookieDomain(host string) bool {
+	host = hostname(host)
+	return config.COOKIE_DOMAIN != "" && (host == config.COOKIE_DOMAIN || strings.HasSuffix(host, "."+config.COOKIE_DOMAIN))
+}
+
+// cookieDomain scopes the session cookie to COOKIE_DOMAIN so it is shared by all subdomains.
+// Requests from other hosts, like localhost during development, get a host only cookie.
+func cookieDomain(r *http.Request) string {
+	if withinCookieDomain(r.Host) {
+		return config.COOKIE_DOMAIN
+	}
+	return ""
+}
+
+// loginURL points to the login page of the central login host, which sends the user back to
+// the original URL afterwards
+func loginURL(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/latios") || !isRedirectHost(r.Host) || hostname(r.Host) == config.LOGIN_HOST {
+		return "/latios/login?redirect=" + url.QueryEscape(r.URL.RequestURI())
+	}
+
+	scheme := requestScheme(r)
+	original := scheme + "://" + r.Host + r.URL.RequestURI()
+	return scheme + "://" + config.LOGIN_HOST + "/latios/login?redirect=" + url.QueryEscape(original)
+}
+
+// isRedirectHost reports whether users may be sent to host after logging in. It has to share the
+// session cookie and be DOMAIN, the login host or the domain of a route.
+func isRedirectHost(host string) bool {
+	host = hostname(host)
+	if !withinCookieDomain(host) {
+		return false
+	}
+	return host == strings.ToLower(config.DOMAIN) || host == config.LOGIN_HOST || db.HasDomain(host)
+}
+
+// safeRedirect returns the redirect target if it is a local path or an http(s) URL on a redirect
+// host, and "/" otherwise. Browsers read "//host", "/\host" and "\\host" as links to another
+// host, so local paths must not start with them.
+func safeRedirect(redirect string) string {
+	if redirect == "" || strings.ContainsAny(redirect, "\\\x00\r\n\t") {
+		return "/"
+	}
+
+	target, err := url.Parse(redirect)
+	if err != nil || target.User != nil || target.Opaque != "" {
+		return "/"
+	}
+
+	if target.Scheme == "" && target.Host == "" {
+		if strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") {
+			return target.String()
+		}
+		return "/"
+	}
+
+	if (target.Scheme == "http" || target.Scheme == "https") && isRedirectHost(target.Host) {
+		return target.String()
+	}
+	return "/"
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+type CreateTokenRequest struct {
+	Name      string     `json:"name"`
+	Scope     string     `json:"scope"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// CreateTokenResponse carries the token itself, it cannot be shown again later
+type CreateTokenResponse struct {
+	db.ApiToken
+	Token string `json:"token"`
+}
+
+// MyTokensApiHandler lists and creates API tokens of the logged in user
+func MyTokensApiHandler(w http.ResponseWriter, r *http.Request) {
+	claims := currentUser(r)
+
+	switch r.Method {
+
+	case http.MethodGet:
+		writeTokens(w, claims.Username)
+
+	case http.MethodPost:
+		// Otherwise a leaked token could be used to keep access after it was revoked
+		if claims.TokenID != 0 {
+			writeErrors(w, http.StatusForbidden, db.FieldError{Field: "token", Message: "api tokens cannot create api tokens"})
+			return
+		}
+
+		var req CreateTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeApiError(w, errBadRequest{err})
+			return
+		}
+
+		token, raw, err := db.CreateApiToken(claims.Username, req.Name, req.Scope, req.ExpiresAt)
+		audit(r, db.AuditTokenCreate, req.Name, err)
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+
+		log.Printf("[AUTH] User %s created api token %s with scope %s", claims.Username, token.Name, token.Scope)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(CreateTokenResponse{ApiToken: token, Token: raw})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// MyTokenApiHandler revokes an API token of the logged in user
+func MyTokenApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	revokeToken(w, r, currentUser(r).Username)
+}
+
+// TokensApiHandler lists the API tokens of all users or of ?username
+func TokensApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeTokens(w, r.URL.Query().Get("username"))
+}
+
+// TokenApiHandler revokes any API token
+func TokenApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	revokeToken(w, r, "")
+}
+
+func writeTokens(w http.ResponseWriter, username string) {
+	tokens, err := db.ApiTokens(username)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func revokeToken(w http.ResponseWriter, r *http.Request, username string) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "id", Message: "invalid token id"})
+		return
+	}
+
+	token, err := db.RevokeApiToken(uint(id), username)
+	audit(r, db.AuditTokenRevoke, token.Name, err)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	log.Printf("[AUTH] Api token %s of user %s revoked by %s", token.Name, token.Username, actorName(r))
+	w.WriteHeader(http.StatusNoContent)
+}
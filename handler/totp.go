@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type TOTPVerifyRequest struct {
+	Code string `json:"code"`
+}
+
+// TOTPDisableRequest confirms with the password, or a code for users without a local password
+type TOTPDisableRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// TOTPApiHandler starts the enrollment with POST and turns two-factor authentication off with DELETE
+func TOTPApiHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectApiToken(w, r) {
+		return
+	}
+	username := currentUser(r).Username
+
+	switch r.Method {
+
+	case http.MethodPost:
+		secret, uri, err := db.BeginTOTP(username)
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TOTPEnrollment{Secret: secret, ProvisioningURI: uri})
+
+	case http.MethodDelete:
+		var req TOTPDisableRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeApiError(w, errBadRequest{err})
+			return
+		}
+
+		err := db.DisableTOTP(username, req.Password, req.Code)
+		audit(r, db.AuditTOTPDisable, username, err)
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+
+		log.Printf("[AUTH] User %s disabled two-factor authentication", username)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// TOTPVerifyApiHandler finishes the enrollment with the first code from the authenticator app
+func TOTPVerifyApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectApiToken(w, r) {
+		return
+	}
+	username := currentUser(r).Username
+
+	var req TOTPVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeApiError(w, errBadRequest{err})
+		return
+	}
+
+	codes, err := db.EnableTOTP(username, req.Code)
+	audit(r, db.AuditTOTPEnable, username, err)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	log.Printf("[AUTH] User %s enabled two-factor authentication", username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodes{RecoveryCodes: codes})
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/timsalokat/latios_proxy/db"
+	"github.com/timsalokat/latios_proxy/routefile"
+)
+
+const maxImportSize = 5 << 20
+
+type ImportReport struct {
+	Mode    string           `json:"mode"`
+	DryRun  bool             `json:"dry_run"`
+	Created int              `json:"created"`
+	Updated int              `json:"updated"`
+	Deleted int              `json:"deleted"`
+	Changes []db.RouteChange `json:"changes"`
+}
+
+// documentFormat picks yaml or json from the format query parameter or the given content type
+func documentFormat(r *http.Request, contentType string) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return strings.ToLower(format)
+	}
+	if strings.Contains(contentType, "yaml") {
+		return "yaml"
+	}
+	return "json"
+}
+
+// RouteExportApiHandler returns all routes as a portable JSON or YAML document
+func RouteExportApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var routes []db.Route
+	if err := db.Client.Order("domain, path_prefix").Find(&routes).Error; err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	format := documentFormat(r, r.Header.Get("Accept"))
+	data, err := routefile.Encode(db.RouteDocument{Routes: routes}, format)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "format", Message: err.Error()})
+		return
+	}
+
+	if format == "yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=latios-routes."+format)
+	w.Write(data)
+}
+
+// RouteImportApiHandler applies a route document. mode=merge (default) creates and updates routes,
+// mode=replace also deletes routes missing from the document. dry_run=true only reports the changes.
+func RouteImportApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "mode", Message: "must be merge or replace"})
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		writeApiError(w, errBadRequest{err})
+		return
+	}
+
+	doc, err := routefile.Decode(data, documentFormat(r, r.Header.Get("Content-Type")))
+	if err != nil {
+		writeApiError(w, errBadRequest{err})
+		return
+	}
+
+	changes, err := db.PlanRoutes(doc.Routes, mode == "replace")
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	report := ImportReport{Mode: mode, DryRun: dryRun, Changes: changes}
+	if report.Changes == nil {
+		report.Changes = []db.RouteChange{}
+	}
+	for _, change := range changes {
+		switch change.Action {
+		case db.ChangeCreate:
+			report.Created++
+		case db.ChangeUpdate:
+			report.Updated++
+		case db.ChangeDelete:
+			report.Deleted++
+		}
+	}
+
+	if !dryRun {
+		err := db.ApplyRouteChanges(changes, actorName(r))
+		audit(r, db.AuditRouteImport, fmt.Sprintf("%s: %d created, %d updated, %d deleted", mode, report.Created, report.Updated, report.Deleted), err)
+		if err != nil {
+			log.Printf("[API] Route import failed: %v", err)
+			writeApiError(w, err)
+			return
+		}
+		log.Printf("[API] Imported routes (%s): %d created, %d updated, %d deleted", mode, report.Created, report.Updated, report.Deleted)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
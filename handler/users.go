@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+type CreateUserRequest struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Role     string   `json:"role"`
+	Groups   []string `json:"groups"`
+}
+
+// UpdateUserRequest changes only the fields that are set
+type UpdateUserRequest struct {
+	Role   *string   `json:"role"`
+	Groups *[]string `json:"groups"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// UsersApiHandler lists and creates users
+func UsersApiHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+
+	case http.MethodGet:
+		users, err := db.ListUsers()
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+
+	case http.MethodPost:
+		var req CreateUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeApiError(w, errBadRequest{err})
+			return
+		}
+
+		user, err := db.CreateUser(req.Username, req.Password, req.Role, req.Groups)
+		audit(r, db.AuditUserCreate, req.Username, err)
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+
+		log.Printf("[API] Created user %s", user.Username)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(user)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// UserApiHandler changes the role and groups of or deletes a single user by ID
+func UserApiHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "id", Message: "invalid user id"})
+		return
+	}
+
+	switch r.Method {
+
+	case http.MethodPatch:
+		var req UpdateUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeApiError(w, errBadRequest{err})
+			return
+		}
+
+		if req.Role == nil && req.Groups == nil {
+			writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "role", Message: "role or groups is required"})
+			return
+		}
+
+		user, err := db.UpdateUser(uint(id), req.Role, req.Groups)
+		if req.Role != nil {
+			audit(r, db.AuditUserRole, fmt.Sprintf("user %d: %s", id, *req.Role), err)
+		}
+		if req.Groups != nil {
+			audit(r, db.AuditUserGroups, fmt.Sprintf("user %d: %s", id, strings.Join(*req.Groups, ",")), err)
+		}
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+
+		if req.Role != nil {
+			log.Printf("[API] User %s now has role %s", user.Username, user.Role)
+		}
+		if req.Groups != nil {
+			log.Printf("[API] User %s now is in groups %v", user.Username, user.Groups)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+
+	case http.MethodDelete:
+		user, err := db.DeleteUser(uint(id))
+		target := user.Username
+		if target == "" {
+			target = fmt.Sprintf("user %d", id)
+		}
+		audit(r, db.AuditUserDelete, target, err)
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+
+		log.Printf("[API] Deleted user %s", user.Username)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// PasswordApiHandler changes the password of the logged in user
+func PasswordApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeApiError(w, errBadRequest{err})
+		return
+	}
+
+	err := db.ChangePassword(user.Username, req.CurrentPassword, req.NewPassword, user.ID)
+	audit(r, db.AuditUserPassword, user.Username, err)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	log.Printf("[AUTH] User %s changed their password", user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,405 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/timsalokat/latios_proxy/config"
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+// How long a passkey ceremony may take between begin and finish
+const webauthnCeremonyLifetime = 5 * time.Minute
+
+// Challenges of finished ceremonies, a signed state can only be used once per instance
+var usedChallenges = make(map[string]time.Time)
+var usedChallengesLock sync.Mutex
+
+// The relying party is COOKIE_DOMAIN so passkeys work on every subdomain. The dashboard and
+// login pages may run on the origins in WEBAUTHN_ORIGINS, by default the login host and DOMAIN.
+var relyingParty = sync.OnceValues(func() (*webauthn.WebAuthn, error) {
+	origins := []string{"https://" + config.LOGIN_HOST}
+	if config.LOGIN_HOST != strings.ToLower(config.DOMAIN) {
+		origins = append(origins, "https://"+strings.ToLower(config.DOMAIN))
+	}
+	if env := os.Getenv("WEBAUTHN_ORIGINS"); env != "" {
+		origins = strings.Split(env, ",")
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          config.COOKIE_DOMAIN,
+		RPDisplayName: "Latios",
+		RPOrigins:     origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+	})
+})
+
+// webauthnUser adapts a user and their passkeys to the WebAuthn library
+type webauthnUser struct {
+	user        db.User
+	credentials []webauthn.Credential
+}
+
+func (u webauthnUser) WebAuthnID() []byte                         { return []byte(strconv.FormatUint(uint64(u.user.ID), 10)) }
+func (u webauthnUser) WebAuthnName() string                       { return u.user.Username }
+func (u webauthnUser) WebAuthnDisplayName() string                { return u.user.Username }
+func (u webauthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// webauthnState carries the ceremony data to the browser and back, signed so it cannot be changed
+type webauthnState struct {
+	Purpose string               `json:"purpose"`
+	Session webauthn.SessionData `json:"session"`
+	jwt.RegisteredClaims
+}
+
+// WebAuthnCeremony is returned by the begin endpoints, options go to navigator.credentials
+// and state has to be sent back to the finish endpoint
+type WebAuthnCeremony struct {
+	Options any    `json:"options"`
+	State   string `json:"state"`
+}
+
+func credentialID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// loadWebAuthnUser returns a user with their decoded passkeys
+func loadWebAuthnUser(userID uint) (webauthnUser, []db.WebAuthnCredential, error) {
+	var user db.User
+	if err := db.Client.First(&user, userID).Error; err != nil {
+		return webauthnUser{}, nil, db.ErrUserNotFound
+	}
+
+	stored, err := db.WebAuthnCredentials(userID)
+	if err != nil {
+		return webauthnUser{}, nil, err
+	}
+
+	result := webauthnUser{user: user}
+	for _, credential := range stored {
+		var decoded webauthn.Credential
+		if err := json.Unmarshal([]byte(credential.Credential), &decoded); err != nil {
+			log.Printf("[AUTH] Skipping broken passkey %d of %s: %v", credential.ID, user.Username, err)
+			continue
+		}
+		result.credentials = append(result.credentials, decoded)
+	}
+	return result, stored, nil
+}
+
+func signState(purpose, subject string, session *webauthn.SessionData) (string, error) {
+	claims := &webauthnState{
+		Purpose: purpose,
+		Session: *session,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(webauthnCeremonyLifetime)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
+// parseState checks the signature, purpose and expiry of a ceremony state and marks its challenge as used
+func parseState(state, purpose string) (*webauthnState, error) {
+	claims := &webauthnState{}
+	token, err := jwt.ParseWithClaims(state, claims, func(t *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil || !token.Valid || claims.Purpose != purpose {
+		return nil, errors.New("invalid or expired passkey request")
+	}
+
+	if !useOnce(claims.Session.Challenge, claims.ExpiresAt.Time) {
+		return nil, errors.New("passkey request was already used")
+	}
+	return claims, nil
+}
+
+// useOnce remembers a challenge until it expires and reports whether it was new
+func useOnce(key string, expires time.Time) bool {
+	usedChallengesLock.Lock()
+	defer usedChallengesLock.Unlock()
+	for challenge, expires := range usedChallenges {
+		if time.Now().After(expires) {
+			delete(usedChallenges, challenge)
+		}
+	}
+	if _, used := usedChallenges[key]; used {
+		return false
+	}
+	usedChallenges[key] = expires
+	return true
+}
+
+func writeCeremony(w http.ResponseWriter, options any, state string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(WebAuthnCeremony{Options: options, State: state})
+}
+
+// WebAuthnRegisterBeginApiHandler starts adding a passkey to the logged in user
+func WebAuthnRegisterBeginApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectApiToken(w, r) {
+		return
+	}
+
+	rp, err := relyingParty()
+	if err != nil {
+		log.Printf("[AUTH] WebAuthn is not configured: %v", err)
+		http.Error(w, "passkeys are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var user db.User
+	if err := db.Client.Where("username = ?", currentUser(r).Username).First(&user).Error; err != nil {
+		writeApiError(w, db.ErrUserNotFound)
+		return
+	}
+	waUser, _, err := loadWebAuthnUser(user.ID)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	options, session, err := rp.BeginRegistration(waUser,
+		webauthn.WithExclusions(webauthn.Credentials(waUser.credentials).CredentialDescriptors()))
+	if err != nil {
+		log.Printf("[AUTH] Couldnt start passkey registration for %s: %v", user.Username, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	state, err := signState("webauthn.register", strconv.FormatUint(uint64(user.ID), 10), session)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeCeremony(w, options, state)
+}
+
+// WebAuthnRegisterFinishApiHandler verifies the new passkey in the body and stores it.
+// The state and an optional name are passed as query parameters.
+func WebAuthnRegisterFinishApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectApiToken(w, r) {
+		return
+	}
+
+	rp, err := relyingParty()
+	if err != nil {
+		http.Error(w, "passkeys are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	state, err := parseState(r.URL.Query().Get("state"), "webauthn.register")
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "state", Message: err.Error()})
+		return
+	}
+	userID, _ := strconv.ParseUint(state.Subject, 10, 64)
+
+	waUser, _, err := loadWebAuthnUser(uint(userID))
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+	if waUser.user.Username != currentUser(r).Username {
+		writeErrors(w, http.StatusForbidden, db.FieldError{Field: "state", Message: "passkey request belongs to another user"})
+		return
+	}
+
+	credential, err := rp.FinishRegistration(waUser, state.Session, r)
+	if err != nil {
+		log.Printf("[AUTH] Passkey registration for %s failed: %v", waUser.user.Username, err)
+		audit(r, db.AuditWebAuthnRegister, waUser.user.Username, err)
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "credential", Message: "passkey could not be verified"})
+		return
+	}
+
+	encoded, err := json.Marshal(credential)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	stored := db.WebAuthnCredential{
+		UserID:       waUser.user.ID,
+		CredentialID: credentialID(credential.ID),
+		Name:         r.URL.Query().Get("name"),
+		Credential:   string(encoded),
+	}
+	err = db.AddWebAuthnCredential(&stored)
+	audit(r, db.AuditWebAuthnRegister, fmt.Sprintf("%s: %s", waUser.user.Username, stored.Name), err)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	log.Printf("[AUTH] User %s registered passkey %s", waUser.user.Username, stored.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(stored)
+}
+
+// WebAuthnLoginBeginApiHandler starts a passwordless login with any passkey of the relying party
+func WebAuthnLoginBeginApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rp, err := relyingParty()
+	if err != nil {
+		log.Printf("[AUTH] WebAuthn is not configured: %v", err)
+		http.Error(w, "passkeys are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	options, session, err := rp.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		log.Printf("[AUTH] Couldnt start passkey login: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	state, err := signState("webauthn.login", "", session)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeCeremony(w, options, state)
+}
+
+// WebAuthnLoginFinishApiHandler verifies the passkey assertion in the body and logs the user in
+// like LoginHandler. Passkeys verify the user themselves, so no second factor is asked for.
+func WebAuthnLoginFinishApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rp, err := relyingParty()
+	if err != nil {
+		http.Error(w, "passkeys are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	state, err := parseState(r.URL.Query().Get("state"), "webauthn.login")
+	if err != nil {
+		http.Error(w, "Login expired, please start again", http.StatusUnauthorized)
+		return
+	}
+
+	var stored []db.WebAuthnCredential
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		userID, err := strconv.ParseUint(string(userHandle), 10, 64)
+		if err != nil {
+			return nil, db.ErrUserNotFound
+		}
+		waUser, credentials, err := loadWebAuthnUser(uint(userID))
+		stored = credentials
+		return waUser, err
+	}
+
+	user, credential, err := rp.FinishPasskeyLogin(findUser, state.Session, r)
+	if err != nil {
+		log.Printf("[AUTH] Passkey login failed: %v", err)
+		auditAs(r, "anonymous", db.AuditLogin, r.Host, fmt.Errorf("passkey: %w", err))
+		http.Error(w, "Invalid passkey", http.StatusUnauthorized)
+		return
+	}
+
+	waUser := user.(webauthnUser)
+	for _, credentialRow := range stored {
+		if credentialRow.CredentialID != credentialID(credential.ID) {
+			continue
+		}
+		encoded, _ := json.Marshal(credential)
+		if err := db.UseWebAuthnCredential(credentialRow.ID, string(encoded)); err != nil {
+			log.Printf("[AUTH] Couldnt update passkey %d of %s: %v", credentialRow.ID, waUser.user.Username, err)
+		}
+	}
+	if credential.Authenticator.CloneWarning {
+		log.Printf("[AUTH] Signature counter of a passkey of %s went backwards, it might be cloned", waUser.user.Username)
+	}
+
+	startSession(w, r, waUser.user, safeRedirect(r.URL.Query().Get("redirect")))
+}
+
+// WebAuthnCredentialsApiHandler lists the passkeys of the logged in user
+func WebAuthnCredentialsApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var user db.User
+	if err := db.Client.Where("username = ?", currentUser(r).Username).First(&user).Error; err != nil {
+		writeApiError(w, db.ErrUserNotFound)
+		return
+	}
+
+	credentials, err := db.WebAuthnCredentials(user.ID)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(credentials)
+}
+
+// WebAuthnCredentialApiHandler removes a passkey of the logged in user
+func WebAuthnCredentialApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectApiToken(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, db.FieldError{Field: "id", Message: "invalid passkey id"})
+		return
+	}
+
+	var user db.User
+	if err := db.Client.Where("username = ?", currentUser(r).Username).First(&user).Error; err != nil {
+		writeApiError(w, db.ErrUserNotFound)
+		return
+	}
+
+	err = db.DeleteWebAuthnCredential(uint(id), user.ID)
+	audit(r, db.AuditWebAuthnDelete, fmt.Sprintf("%s: passkey %d", user.Username, id), err)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+
+	log.Printf("[AUTH] User %s removed passkey %d", user.Username, id)
+	w.WriteHeader(http.StatusNoContent)
+}
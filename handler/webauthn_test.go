@@ -0,0 +1,294 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/timsalokat/latios_proxy/db"
+)
+
+const testOrigin = "https://login.example.com"
+
+// softAuthenticator is a passkey in memory that answers ceremonies like a platform
+// authenticator with "none" attestation
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	counter      uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, credentialID: id}
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": testOrigin})
+	return data
+}
+
+// authenticatorData has the RP ID hash, the flags user present and verified and the counter
+func (a *softAuthenticator) authenticatorData(flags byte) *bytes.Buffer {
+	rpIDHash := sha256.Sum256([]byte("example.com"))
+	data := bytes.NewBuffer(rpIDHash[:])
+	data.WriteByte(0x01 | 0x04 | flags)
+	binary.Write(data, binary.BigEndian, a.counter)
+	return data
+}
+
+// create answers navigator.credentials.create
+func (a *softAuthenticator) create(t *testing.T, challenge string) []byte {
+	t.Helper()
+	publicKey, err := cbor.Marshal(map[int]any{
+		1: 2, 3: -7, -1: 1, // EC2 key for ES256 on P-256
+		-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authData := a.authenticatorData(0x40) // attested credential data included
+	authData.Write(make([]byte, 16))      // AAGUID
+	binary.Write(authData, binary.BigEndian, uint16(len(a.credentialID)))
+	authData.Write(a.credentialID)
+	authData.Write(publicKey)
+
+	attestation, err := cbor.Marshal(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": authData.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.response(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", challenge)),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+	})
+}
+
+// get answers navigator.credentials.get, signed with key
+func (a *softAuthenticator) get(t *testing.T, challenge string, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	a.counter++
+	clientData := a.clientData("webauthn.get", challenge)
+	authData := a.authenticatorData(0)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData.Bytes(), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.response(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData.Bytes()),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+	})
+}
+
+func (a *softAuthenticator) response(response map[string]string) []byte {
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	body, _ := json.Marshal(map[string]any{"id": id, "rawId": id, "type": "public-key", "response": response})
+	return body
+}
+
+type testCeremony struct {
+	Options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	} `json:"options"`
+	State string `json:"state"`
+}
+
+func beginCeremony(t *testing.T, handler http.HandlerFunc, claims *Claims) testCeremony {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	if claims != nil {
+		req = withUser(req, claims)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin: %d %s", w.Code, w.Body)
+	}
+
+	var ceremony testCeremony
+	if err := json.NewDecoder(w.Body).Decode(&ceremony); err != nil {
+		t.Fatal(err)
+	}
+	return ceremony
+}
+
+func finishRegistration(claims *Claims, state string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/?name=laptop&state="+url.QueryEscape(state), bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	WebAuthnRegisterFinishApiHandler(w, withUser(req, claims))
+	return w
+}
+
+func finishLogin(state string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/?redirect=/dashboard&state="+url.QueryEscape(state), bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	WebAuthnLoginFinishApiHandler(w, req)
+	return w
+}
+
+// registerPasskey adds the authenticator to the user through the API
+func registerPasskey(t *testing.T, user db.User, authenticator *softAuthenticator) {
+	t.Helper()
+	claims := &Claims{Username: user.Username, Role: user.Role}
+	ceremony := beginCeremony(t, WebAuthnRegisterBeginApiHandler, claims)
+
+	w := finishRegistration(claims, ceremony.State, authenticator.create(t, ceremony.Options.PublicKey.Challenge))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register: %d %s", w.Code, w.Body)
+	}
+	authenticator.userHandle = []byte(strconv.FormatUint(uint64(user.ID), 10))
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "alice", db.RoleEditor)
+	claims := &Claims{Username: "alice", Role: db.RoleEditor}
+	authenticator := newSoftAuthenticator(t)
+
+	ceremony := beginCeremony(t, WebAuthnRegisterBeginApiHandler, claims)
+	body := authenticator.create(t, ceremony.Options.PublicKey.Challenge)
+
+	if w := finishRegistration(&Claims{Username: "mallory", Role: db.RoleAdmin}, ceremony.State, body); w.Code != http.StatusForbidden {
+		t.Errorf("finish as another user: %d, want 403", w.Code)
+	}
+
+	// The state was used by the rejected attempt, a new ceremony is needed
+	ceremony = beginCeremony(t, WebAuthnRegisterBeginApiHandler, claims)
+	body = authenticator.create(t, ceremony.Options.PublicKey.Challenge)
+	if w := finishRegistration(claims, ceremony.State, body); w.Code != http.StatusCreated {
+		t.Fatalf("finish: %d %s", w.Code, w.Body)
+	}
+	if w := finishRegistration(claims, ceremony.State, body); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed finish: %d, want 400", w.Code)
+	}
+
+	credentials, err := db.WebAuthnCredentials(user.ID)
+	if err != nil || len(credentials) != 1 || credentials[0].Name != "laptop" {
+		t.Fatalf("stored passkeys = %+v, %v", credentials, err)
+	}
+
+	// The same authenticator cannot be registered twice
+	ceremony = beginCeremony(t, WebAuthnRegisterBeginApiHandler, claims)
+	if w := finishRegistration(claims, ceremony.State, authenticator.create(t, ceremony.Options.PublicKey.Challenge)); w.Code != http.StatusConflict {
+		t.Errorf("duplicate passkey: %d, want 409", w.Code)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "alice", db.RoleEditor)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, user, authenticator)
+
+	ceremony := beginCeremony(t, WebAuthnLoginBeginApiHandler, nil)
+	body := authenticator.get(t, ceremony.Options.PublicKey.Challenge, authenticator.key)
+	w := finishLogin(ceremony.State, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+
+	var response LoginResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.Redirect != "/dashboard" {
+		t.Errorf("redirect = %q, want /dashboard", response.Redirect)
+	}
+
+	// The cookie is a working session of the user
+	req := httptest.NewRequest(http.MethodGet, "/latios-api/routes", nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	var claims *Claims
+	AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims = currentUser(r)
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if claims == nil || claims.Username != "alice" {
+		t.Errorf("session cookie does not authenticate alice: %+v", claims)
+	}
+
+	credentials, _ := db.WebAuthnCredentials(user.ID)
+	if len(credentials) != 1 || credentials[0].LastUsedAt == nil {
+		t.Errorf("last use of the passkey was not recorded: %+v", credentials)
+	}
+
+	if w := finishLogin(ceremony.State, body); w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed login: %d, want 401", w.Code)
+	}
+}
+
+func TestPasskeyLoginWithWrongKey(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "alice", db.RoleEditor)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, user, authenticator)
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ceremony := beginCeremony(t, WebAuthnLoginBeginApiHandler, nil)
+	w := finishLogin(ceremony.State, authenticator.get(t, ceremony.Options.PublicKey.Challenge, other))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("login signed by another key: %d, want 401", w.Code)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("failed login set cookies: %v", w.Result().Cookies())
+	}
+}
+
+func TestPasskeyChangesRejectApiTokens(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "alice", db.RoleEditor)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, user, authenticator)
+	token := &Claims{Username: "alice", Role: db.RoleEditor, TokenID: 1}
+
+	w := httptest.NewRecorder()
+	WebAuthnRegisterBeginApiHandler(w, withUser(httptest.NewRequest(http.MethodPost, "/", nil), token))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("begin with api token: %d, want 403", w.Code)
+	}
+
+	// Even with a state from a session, the finish step needs the session
+	ceremony := beginCeremony(t, WebAuthnRegisterBeginApiHandler, &Claims{Username: "alice", Role: db.RoleEditor})
+	second := newSoftAuthenticator(t)
+	if w := finishRegistration(token, ceremony.State, second.create(t, ceremony.Options.PublicKey.Challenge)); w.Code != http.StatusForbidden {
+		t.Errorf("finish with api token: %d, want 403", w.Code)
+	}
+
+	credentials, _ := db.WebAuthnCredentials(user.ID)
+	req := httptest.NewRequest(http.MethodDelete, "/", nil)
+	req.SetPathValue("id", strconv.FormatUint(uint64(credentials[0].ID), 10))
+	w = httptest.NewRecorder()
+	WebAuthnCredentialApiHandler(w, withUser(req, token))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("delete with api token: %d, want 403", w.Code)
+	}
+
+	if credentials, _ := db.WebAuthnCredentials(user.ID); len(credentials) != 1 {
+		t.Errorf("passkeys = %d, want 1", len(credentials))
+	}
+}
@@ -0,0 +1,75 @@
+// Passkey helpers, the server sends WebAuthn options with base64url encoded binary fields
+
+function toBuffer(value: string): ArrayBuffer {
+  const base64 = value.replace(/-/g, '+').replace(/_/g, '/')
+  const binary = atob(base64 + '='.repeat((4 - (base64.length % 4)) % 4))
+  return Uint8Array.from(binary, (c) => c.charCodeAt(0)).buffer
+}
+
+function toBase64url(buffer: ArrayBuffer | null): string | undefined {
+  if (!buffer) return undefined
+  const binary = String.fromCharCode(...new Uint8Array(buffer))
+  return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+}
+
+function encodeCredential(credential: PublicKeyCredential) {
+  const response = credential.response as AuthenticatorAttestationResponse & AuthenticatorAssertionResponse
+  return {
+    id: credential.id,
+    rawId: toBase64url(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: toBase64url(response.clientDataJSON),
+      attestationObject: toBase64url(response.attestationObject ?? null),
+      authenticatorData: toBase64url(response.authenticatorData ?? null),
+      signature: toBase64url(response.signature ?? null),
+      userHandle: toBase64url(response.userHandle ?? null),
+      transports: response.getTransports?.(),
+    },
+  }
+}
+
+async function begin(path: string) {
+  const response = await fetch(path, { method: 'POST' })
+  if (!response.ok) {
+    throw new Error(`HTTP error! status: ${response.status}`)
+  }
+  return response.json()
+}
+
+async function finish(path: string, body: object) {
+  const response = await fetch(path, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(body),
+  })
+  if (!response.ok) {
+    throw new Error(`HTTP error! status: ${response.status}`)
+  }
+  return response.json()
+}
+
+// registerPasskey adds a passkey to the logged in user
+export async function registerPasskey(name: string) {
+  const ceremony = await begin('/latios-api/webauthn/register/begin')
+  const options = ceremony.options.publicKey
+  options.challenge = toBuffer(options.challenge)
+  options.user.id = toBuffer(options.user.id)
+  options.excludeCredentials = (options.excludeCredentials ?? []).map((c: any) => ({ ...c, id: toBuffer(c.id) }))
+
+  const credential = (await navigator.credentials.create({ publicKey: options })) as PublicKeyCredential
+  const query = new URLSearchParams({ state: ceremony.state, name })
+  return finish(`/latios-api/webauthn/register/finish?${query}`, encodeCredential(credential))
+}
+
+// loginWithPasskey logs in with any passkey and returns the page to continue on
+export async function loginWithPasskey(redirect: string): Promise<string> {
+  const ceremony = await begin('/latios-api/webauthn/login/begin')
+  const options = ceremony.options.publicKey
+  options.challenge = toBuffer(options.challenge)
+
+  const credential = (await navigator.credentials.get({ publicKey: options })) as PublicKeyCredential
+  const query = new URLSearchParams({ state: ceremony.state, redirect })
+  const result = await finish(`/latios-api/webauthn/login/finish?${query}`, encodeCredential(credential))
+  return result.redirect || '/'
+}
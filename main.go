@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/timsalokat/latios_proxy/certs"
@@ -12,6 +13,7 @@ import (
 	"github.com/timsalokat/latios_proxy/db"
 	"github.com/timsalokat/latios_proxy/handler"
 	"github.com/timsalokat/latios_proxy/middleware"
+	"github.com/timsalokat/latios_proxy/routefile"
 	"golang.org/x/time/rate"
 )
 
@@ -24,8 +26,28 @@ func main() {
 	log.Println("[CONFIG] Loading configuration...")
 	config.LoadConfig()
 
+	// Roll the schema back for a downgrade and exit, e.g. DB_ROLLBACK_TO=1
+	if target := os.Getenv("DB_ROLLBACK_TO"); target != "" {
+		version, err := strconv.Atoi(target)
+		if err != nil || version < 0 {
+			log.Fatalf("[DB] Invalid DB_ROLLBACK_TO: %s", target)
+		}
+		db.Connect()
+		if err := db.RollbackTo(version); err != nil {
+			log.Fatalf("[DB] Rollback failed: %v", err)
+		}
+		return
+	}
+
 	log.Println("[DB] Initializing database...")
 	db.InitDB()
+	db.StartRouteSync()
+
+	routefile.Start()
+
+	handler.InitProxies()
+	handler.StartHealthChecker()
+	handler.InitProvider()
 
 	router := http.NewServeMux()
 
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/timsalokat/latios_proxy/config"
+)
+
+// ClientIP returns the address of the client. X-Forwarded-For can be set by anyone, so it is
+// only used for requests from TRUSTED_PROXIES. The rightmost entry that is not a trusted
+// proxy is the client, entries left of it may be forged.
+func ClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !trustedProxy(remote) {
+		return remote
+	}
+
+	entries := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(entries[i]))
+		if err != nil {
+			break
+		}
+		if !trustedProxy(addr.String()) {
+			return addr.String()
+		}
+	}
+	return remote
+}
+
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range config.TRUSTED_PROXIES {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
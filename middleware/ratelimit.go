@@ -1,7 +1,6 @@
 package middleware
 
 import (
-	"net"
 	"net/http"
 	"sync"
 
@@ -42,17 +41,7 @@ func (rateLimiter *IPRateLimiter) getLimiter(ip string) *rate.Limiter {
 func (rateLimiter *IPRateLimiter) RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		// Get IP from header if proxied by cloudflare or nginx
-		clientIP := r.Header.Get("X-Forwarded-For")
-		if clientIP == "" {
-			var err error
-			clientIP, _, err = net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				clientIP = r.RemoteAddr
-			}
-		}
-
-		limiter := rateLimiter.getLimiter(clientIP)
+		limiter := rateLimiter.getLimiter(ClientIP(r))
 		if !limiter.Allow() {
 			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 			return
@@ -0,0 +1,165 @@
+// Package routefile keeps the route table in sync with a declarative YAML or JSON file.
+package routefile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/timsalokat/latios_proxy/db"
+	"gopkg.in/yaml.v3"
+)
+
+var logPrefix = "[ROUTES-FILE] "
+
+const pollInterval = 5 * time.Second
+
+// Start loads the file set in ROUTES_FILE and reconciles it into the database on every change.
+// With ROUTES_FILE_DRY_RUN=true the changes are only logged.
+func Start() {
+	path := os.Getenv("ROUTES_FILE")
+	if path == "" {
+		return
+	}
+	dryRun := os.Getenv("ROUTES_FILE_DRY_RUN") == "true"
+
+	log.Printf("%sManaging routes from %s (dry run: %t)", logPrefix, path, dryRun)
+	modTime, err := syncFile(path, dryRun)
+	if err != nil {
+		log.Fatalf("%sFailed to sync routes: %v", logPrefix, err)
+	}
+
+	go watch(path, dryRun, modTime)
+}
+
+// watch polls the modification time and syncs again after the file was changed
+func watch(path string, dryRun bool, lastModTime time.Time) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("%sCannot stat %s: %v", logPrefix, path, err)
+			continue
+		}
+		if info.ModTime().Equal(lastModTime) {
+			continue
+		}
+
+		log.Printf("%s%s changed, syncing routes", logPrefix, path)
+		modTime, err := syncFile(path, dryRun)
+		if err != nil {
+			// Keep the running configuration and retry once the file changes again
+			log.Printf("%sFailed to sync routes: %v", logPrefix, err)
+		}
+		lastModTime = modTime
+	}
+}
+
+func syncFile(path string, dryRun bool) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	doc, err := Load(path)
+	if err != nil {
+		return info.ModTime(), err
+	}
+
+	changes, err := db.PlanRoutes(doc.Routes, true)
+	if err != nil {
+		return info.ModTime(), err
+	}
+
+	if len(changes) == 0 {
+		log.Printf("%sRoutes are up to date", logPrefix)
+		return info.ModTime(), nil
+	}
+	for _, change := range changes {
+		log.Printf("%s%s", logPrefix, change)
+	}
+
+	if dryRun {
+		log.Printf("%sDry run, %d changes not applied", logPrefix, len(changes))
+		return info.ModTime(), nil
+	}
+
+	err = db.ApplyRouteChanges(changes, "routes-file")
+
+	entry := db.AuditLog{Actor: "routes-file", Action: db.AuditRouteSync, Target: path, Result: db.AuditSuccess}
+	if err != nil {
+		entry.Result = db.AuditFailure
+		entry.Details = err.Error()
+	}
+	db.RecordAudit(entry)
+
+	if err != nil {
+		return info.ModTime(), err
+	}
+	log.Printf("%sApplied %d changes", logPrefix, len(changes))
+	return info.ModTime(), nil
+}
+
+// Load reads a route document, .json files are parsed as JSON and everything else as YAML
+func Load(path string) (db.RouteDocument, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return db.RouteDocument{}, err
+	}
+
+	format := "yaml"
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		format = "json"
+	}
+	return Decode(data, format)
+}
+
+// Decode parses a route document in the given format, unknown fields are rejected
+func Decode(data []byte, format string) (db.RouteDocument, error) {
+	var doc db.RouteDocument
+
+	switch format {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&doc); err != nil {
+			return doc, fmt.Errorf("invalid route document: %w", err)
+		}
+	case "yaml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&doc); err != nil {
+			return doc, fmt.Errorf("invalid route document: %w", err)
+		}
+	default:
+		return doc, fmt.Errorf("unsupported route document format %q", format)
+	}
+
+	return doc, nil
+}
+
+// Encode writes a route document without database IDs in the given format
+func Encode(doc db.RouteDocument, format string) ([]byte, error) {
+	routes := make([]db.Route, len(doc.Routes))
+	for i, route := range doc.Routes {
+		route.ID = 0
+		routes[i] = route
+	}
+	doc.Routes = routes
+
+	switch format {
+	case "json":
+		return json.MarshalIndent(doc, "", "  ")
+	case "yaml":
+		return yaml.Marshal(doc)
+	default:
+		return nil, fmt.Errorf("unsupported route document format %q", format)
+	}
+}